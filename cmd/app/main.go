@@ -11,18 +11,25 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"remnawave-tg-shop-bot/internal/alert"
+	"remnawave-tg-shop-bot/internal/broadcast"
+	"remnawave-tg-shop-bot/internal/channel"
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/cryptopay"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/handler"
+	"remnawave-tg-shop-bot/internal/location"
 	"remnawave-tg-shop-bot/internal/notification"
 	"remnawave-tg-shop-bot/internal/payment"
 	"remnawave-tg-shop-bot/internal/remnawave"
 	"remnawave-tg-shop-bot/internal/sync"
+	"remnawave-tg-shop-bot/internal/timezone"
 	"remnawave-tg-shop-bot/internal/translation"
+	"remnawave-tg-shop-bot/internal/webhook"
 	"remnawave-tg-shop-bot/internal/yookasa"
 	"strconv"
 	"strings"
+	_ "time/tzdata"
 )
 
 func main() {
@@ -37,29 +44,38 @@ func main() {
 		panic(err)
 	}
 
+	b, err := bot.New(config.TelegramToken(), bot.WithWorkers(3))
+	if err != nil {
+		panic(err)
+	}
+	alert.Init(b)
+
 	pool, err := initDatabase(ctx, config.DadaBaseUrl())
 	if err != nil {
+		alert.SendNow(alert.Database, fmt.Sprintf("Failed to connect to the database, the bot is stopped: %v", err))
 		panic(err)
 	}
 
 	err = database.RunMigrations(ctx, &database.MigrationConfig{Direction: "up", MigrationsPath: "./db/migrations", Steps: 0}, pool)
 	if err != nil {
+		alert.SendNow(alert.Migration, fmt.Sprintf("Failed to run migrations, the bot is stopped: %v", err))
 		panic(err)
 	}
 
 	customerRepository := database.NewCustomerRepository(pool)
 	purchaseRepository := database.NewPurchaseRepository(pool)
 	referralRepository := database.NewReferralRepository(pool)
+	trialRepository := database.NewTrialRepository(pool)
+	notificationLogRepository := database.NewNotificationLogRepository(pool)
+	campaignRepository := database.NewCampaignRepository(pool)
 
 	cryptoPayClient := cryptopay.NewCryptoPayClient(config.CryptoPayUrl(), config.CryptoPayToken())
-	remnawaveClient := remnawave.NewClient(config.RemnawaveUrl(), config.RemnawaveToken(), config.RemnawaveMode())
+	panels := remnawave.NewPanels(config.Panels(), config.PanelPlacement())
 	yookasaClient := yookasa.NewClient(config.YookasaUrl(), config.YookasaShopId(), config.YookasaSecretKey())
-	b, err := bot.New(config.TelegramToken(), bot.WithWorkers(3))
-	if err != nil {
-		panic(err)
-	}
 
-	paymentService := payment.NewPaymentService(tm, purchaseRepository, remnawaveClient, customerRepository, b, cryptoPayClient, yookasaClient, referralRepository)
+	channelService := channel.NewService(b, customerRepository, panels, tm)
+
+	paymentService := payment.NewPaymentService(tm, purchaseRepository, panels, customerRepository, b, cryptoPayClient, yookasaClient, referralRepository, trialRepository, channelService, campaignRepository)
 
 	cronScheduler := setupInvoiceChecker(purchaseRepository, cryptoPayClient, paymentService, yookasaClient)
 	if cronScheduler != nil {
@@ -67,15 +83,53 @@ func main() {
 		defer cronScheduler.Stop()
 	}
 
-	subService := notification.NewSubscriptionService(customerRepository, b, tm)
+	subService := notification.NewSubscriptionService(customerRepository, notificationLogRepository, b, tm)
 
 	subscriptionNotificationCronScheduler := setupSubscriptionNotifier(subService)
 	subscriptionNotificationCronScheduler.Start()
 	defer subscriptionNotificationCronScheduler.Stop()
 
-	syncService := sync.NewSyncService(remnawaveClient, customerRepository)
+	channelRecheckCronScheduler := setupChannelRecheck(channelService)
+	if channelRecheckCronScheduler != nil {
+		channelRecheckCronScheduler.Start()
+		defer channelRecheckCronScheduler.Stop()
+	}
 
-	h := handler.NewHandler(syncService, paymentService, tm, customerRepository, purchaseRepository, cryptoPayClient, yookasaClient, referralRepository)
+	nodeMonitorCronScheduler := setupNodeMonitor(notification.NewNodeMonitor(panels, b))
+	if nodeMonitorCronScheduler != nil {
+		nodeMonitorCronScheduler.Start()
+		defer nodeMonitorCronScheduler.Stop()
+	}
+
+	trafficMonitorCronScheduler := setupTrafficMonitor(notification.NewTrafficMonitor(panels, customerRepository, notificationLogRepository, b, tm))
+	if trafficMonitorCronScheduler != nil {
+		trafficMonitorCronScheduler.Start()
+		defer trafficMonitorCronScheduler.Stop()
+	}
+
+	campaignCronScheduler := setupCampaigns(notification.NewCampaignService(customerRepository, campaignRepository, b, tm))
+	if campaignCronScheduler != nil {
+		campaignCronScheduler.Start()
+		defer campaignCronScheduler.Stop()
+	}
+
+	reportCronScheduler := setupReports(notification.NewReportService(database.NewReportRepository(pool), b))
+	if reportCronScheduler != nil {
+		reportCronScheduler.Start()
+		defer reportCronScheduler.Stop()
+	}
+
+	syncService := sync.NewSyncService(panels, customerRepository, database.NewSyncRunRepository(pool), purchaseRepository)
+
+	syncCronScheduler := setupSyncScheduler(syncService)
+	if syncCronScheduler != nil {
+		syncCronScheduler.Start()
+		defer syncCronScheduler.Stop()
+	}
+
+	locationService := location.NewService(panels, tm)
+
+	h := handler.NewHandler(syncService, paymentService, tm, customerRepository, purchaseRepository, cryptoPayClient, yookasaClient, referralRepository, trialRepository, channelService, panels, locationService, campaignRepository)
 
 	me, err := b.GetMe(ctx)
 	if err != nil {
@@ -109,15 +163,27 @@ func main() {
 
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/start", bot.MatchTypePrefix, h.StartCommandHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/connect", bot.MatchTypeExact, h.ConnectCommandHandler, h.CreateCustomerIfNotExistMiddleware)
-	b.RegisterHandler(bot.HandlerTypeMessageText, "/sync", bot.MatchTypeExact, h.SyncUsersCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/sync", bot.MatchTypePrefix, h.SyncUsersCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/restore", bot.MatchTypePrefix, h.RestoreUsersCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/duplicates", bot.MatchTypeExact, h.DuplicatesCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/campaigns", bot.MatchTypeExact, h.CampaignsCommandHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackMergeDuplicate, bot.MatchTypePrefix, h.ResolveDuplicateCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackCleanupDuplicate, bot.MatchTypePrefix, h.ResolveDuplicateCallbackHandler, isAdminMiddleware)
 
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackReferral, bot.MatchTypeExact, h.ReferralCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBuy, bot.MatchTypeExact, h.BuyCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackTrial, bot.MatchTypeExact, h.TrialCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackActivateTrial, bot.MatchTypeExact, h.ActivateTrialCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackCheckChannel, bot.MatchTypeExact, h.CheckChannelCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackClaimReferral, bot.MatchTypeExact, h.ClaimReferralBonusCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackStart, bot.MatchTypeExact, h.StartCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSell, bot.MatchTypePrefix, h.SellCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackConnect, bot.MatchTypeExact, h.ConnectCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackResetLink, bot.MatchTypeExact, h.ResetLinkCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackConfirmReset, bot.MatchTypeExact, h.ConfirmResetLinkCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackServerStatus, bot.MatchTypeExact, h.ServerStatusCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSettings, bot.MatchTypeExact, h.SettingsCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackSetTimezone, bot.MatchTypePrefix, h.SetTimezoneCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackPayment, bot.MatchTypePrefix, h.PaymentCallbackHandler, h.CreateCustomerIfNotExistMiddleware)
 	b.RegisterHandlerMatchFunc(func(update *models.Update) bool {
 		return update.PreCheckoutQuery != nil
@@ -126,9 +192,31 @@ func main() {
 	b.RegisterHandlerMatchFunc(func(update *models.Update) bool {
 		return update.Message != nil && update.Message.SuccessfulPayment != nil
 	}, h.SuccessPaymentHandler)
-	
+
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/pm", bot.MatchTypePrefix, h.PMCommandHandler, isAdminMiddleware)
-	
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastButtons, bot.MatchTypePrefix, h.BroadcastButtonsCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastSend, bot.MatchTypePrefix, h.BroadcastSendCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastCancel, bot.MatchTypePrefix, h.BroadcastCancelCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastAudience, bot.MatchTypePrefix, h.BroadcastAudienceCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastPreview, bot.MatchTypePrefix, h.BroadcastPreviewCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastSchedule, bot.MatchTypePrefix, h.BroadcastScheduleCallbackHandler, isAdminMiddleware)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, handler.CallbackBroadcastStop, bot.MatchTypePrefix, h.BroadcastStopCallbackHandler, isAdminMiddleware)
+	// registered last: any other message of the admin may be the content of a broadcast draft
+	b.RegisterHandlerMatchFunc(func(update *models.Update) bool {
+		return update.Message != nil && update.Message.From != nil && update.Message.From.ID == config.GetAdminTelegramId() &&
+			update.Message.SuccessfulPayment == nil && !strings.HasPrefix(update.Message.Text, "/")
+	}, h.BroadcastDraftMessageHandler)
+
+	if config.IsWebhookEnabled() {
+		webhookServer := webhook.NewServer(customerRepository, b, tm)
+		go webhookServer.Start(ctx)
+	}
+	if addr := config.MetricsAddr(); addr != "" {
+		go remnawave.ServeMetrics(ctx, addr)
+	}
+
+	go broadcast.NewWorker(broadcast.NewBroadcastRepository(pool), b).Run(ctx)
+
 	slog.Info("Bot is starting...")
 	b.Start(ctx)
 }
@@ -137,6 +225,8 @@ func isAdminMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
 		if update.Message != nil && update.Message.From.ID == config.GetAdminTelegramId() {
 			next(ctx, b, update)
+		} else if update.CallbackQuery != nil && update.CallbackQuery.From.ID == config.GetAdminTelegramId() {
+			next(ctx, b, update)
 		} else {
 			return
 		}
@@ -146,7 +236,7 @@ func isAdminMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 func setupSubscriptionNotifier(subService *notification.SubscriptionService) *cron.Cron {
 	c := cron.New()
 
-	_, err := c.AddFunc("0 16 * * *", func() {
+	_, err := c.AddFunc("0 * * * *", func() {
 		slog.Info("Running subscription notification check")
 
 		err := subService.SendSubscriptionNotifications(context.Background())
@@ -161,6 +251,149 @@ func setupSubscriptionNotifier(subService *notification.SubscriptionService) *cr
 	return c
 }
 
+func setupChannelRecheck(channelService *channel.Service) *cron.Cron {
+	if !config.IsChannelRecheckEnabled() {
+		return nil
+	}
+	c := cron.New()
+
+	_, err := c.AddFunc("0 * * * *", func() {
+		slog.Info("Running channel membership recheck")
+
+		err := channelService.RevokeTrialsOfLeavers(context.Background())
+		if err != nil {
+			slog.Error("Error rechecking channel membership", "error", err)
+		}
+	})
+
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func setupSyncScheduler(syncService *sync.SyncService) *cron.Cron {
+	if config.SyncCron() == "" {
+		return nil
+	}
+	c := cron.New()
+
+	_, err := c.AddFunc(config.SyncCron(), func() {
+		slog.Info("Running scheduled sync")
+
+		_, err := syncService.Sync(context.Background(), sync.Options{Trigger: database.SyncTriggerCron})
+		if err != nil {
+			slog.Error("Error running scheduled sync", "error", err)
+		}
+	})
+
+	if err != nil {
+		panic(fmt.Sprintf("SYNC_CRON .env variable is not a valid cron expression: %v", err))
+	}
+	return c
+}
+
+func setupNodeMonitor(nodeMonitor *notification.NodeMonitor) *cron.Cron {
+	if !config.IsNodeAlertsEnabled() {
+		return nil
+	}
+	c := cron.New()
+
+	_, err := c.AddFunc("* * * * *", func() {
+		err := nodeMonitor.CheckNodes(context.Background())
+		if err != nil {
+			slog.Error("Error checking nodes", "error", err)
+		}
+	})
+
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func setupTrafficMonitor(trafficMonitor *notification.TrafficMonitor) *cron.Cron {
+	if len(config.TrafficThresholds()) == 0 {
+		return nil
+	}
+	c := cron.New()
+
+	_, err := c.AddFunc("*/30 * * * *", func() {
+		slog.Info("Running traffic threshold check")
+
+		err := trafficMonitor.CheckTraffic(context.Background())
+		if err != nil {
+			slog.Error("Error checking traffic thresholds", "error", err)
+		}
+	})
+
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func setupCampaigns(campaignService *notification.CampaignService) *cron.Cron {
+	if len(config.Campaigns()) == 0 {
+		return nil
+	}
+	c := cron.New()
+
+	_, err := c.AddFunc("30 * * * *", func() {
+		slog.Info("Running win-back campaigns")
+
+		err := campaignService.RunCampaigns(context.Background())
+		if err != nil {
+			slog.Error("Error running win-back campaigns", "error", err)
+		}
+	})
+
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// setupReports sends the reports at 09:00 of DEFAULT_TIMEZONE, the weekly one on Mondays.
+func setupReports(reportService *notification.ReportService) *cron.Cron {
+	if !config.DailyReportEnabled() && !config.WeeklyReportEnabled() {
+		return nil
+	}
+	c := cron.New(cron.WithLocation(timezone.Load(config.DefaultTimezone())))
+
+	if config.DailyReportEnabled() {
+		_, err := c.AddFunc("0 9 * * *", func() {
+			slog.Info("Sending daily report")
+
+			err := reportService.SendDailyReport(context.Background())
+			if err != nil {
+				slog.Error("Error sending daily report", "error", err)
+			}
+		})
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if config.WeeklyReportEnabled() {
+		_, err := c.AddFunc("0 9 * * 1", func() {
+			slog.Info("Sending weekly report")
+
+			err := reportService.SendWeeklyReport(context.Background())
+			if err != nil {
+				slog.Error("Error sending weekly report", "error", err)
+			}
+		})
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return c
+}
+
 func initDatabase(ctx context.Context, connString string) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
@@ -178,11 +411,22 @@ func setupInvoiceChecker(
 	cryptoPayClient *cryptopay.Client,
 	paymentService *payment.PaymentService,
 	yookasaClient *yookasa.Client) *cron.Cron {
-	if !config.IsYookasaEnabled() && !config.IsCryptoPayEnabled() {
+	if !config.IsYookasaEnabled() && !config.IsCryptoPayEnabled() && !config.IsTelegramStarsEnabled() {
 		return nil
 	}
 	c := cron.New(cron.WithSeconds())
 
+	if config.IsTelegramStarsEnabled() {
+		// a run can outlast the interval while the panel is slow, the next one must not retry the same purchases
+		_, err := c.AddJob("0 * * * * *", cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).Then(cron.FuncJob(func() {
+			paymentService.RetryReceivedPurchases(context.Background())
+		})))
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	if config.IsCryptoPayEnabled() {
 		_, err := c.AddFunc("*/5 * * * * *", func() {
 			ctx := context.Background()
@@ -233,6 +477,7 @@ func checkYookasaInvoice(
 
 		if err != nil {
 			slog.Error("Error getting invoice", "invoiceId", purchase.YookasaID, err)
+			alert.Sendf(alert.ProviderError, "YooKassa: failed to get payment of purchase #%d: %v", purchase.ID, err)
 			continue
 		}
 
@@ -252,8 +497,7 @@ func checkYookasaInvoice(
 		if err != nil {
 			slog.Error("Error parsing purchaseId", "invoiceId", invoice.ID, err)
 		}
-		ctxWithValue := context.WithValue(ctx, "username", invoice.Metadata["username"])
-		err = paymentService.ProcessPurchaseById(ctxWithValue, int64(purchaseId))
+		err = paymentService.ProcessPurchaseById(ctx, int64(purchaseId))
 		if err != nil {
 			slog.Error("Error processing invoice", "invoiceId", invoice.ID, "purchaseId", purchaseId, err)
 		} else {
@@ -298,6 +542,7 @@ func checkCryptoPayInvoice(
 	invoices, err := cryptoPayClient.GetInvoices("", "", "", stringInvoiceIDs, 0, 0)
 	if err != nil {
 		log.Printf("Error getting invoices: %v", err)
+		alert.Sendf(alert.ProviderError, "CryptoPay: failed to get invoices: %v", err)
 		return
 	}
 
@@ -305,9 +550,11 @@ func checkCryptoPayInvoice(
 		if invoice.InvoiceID != nil && invoice.IsPaid() {
 			payload := strings.Split(invoice.Payload, "&")
 			purchaseID, err := strconv.Atoi(strings.Split(payload[0], "=")[1])
-			username := strings.Split(payload[1], "=")[1]
-			ctxWithUsername := context.WithValue(ctx, "username", username)
-			err = paymentService.ProcessPurchaseById(ctxWithUsername, int64(purchaseID))
+			if err != nil {
+				slog.Error("Error parsing purchase id", "invoiceId", invoice.InvoiceID, "error", err)
+				continue
+			}
+			err = paymentService.ProcessPurchaseById(ctx, int64(purchaseID))
 			if err != nil {
 				slog.Error("Error processing invoice", "invoiceId", invoice.InvoiceID, err)
 			} else {
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS trial_ledger;
+ALTER TABLE customer DROP COLUMN IF EXISTS trial_used_at;
+
+COMMIT;
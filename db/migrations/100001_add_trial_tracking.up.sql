@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS trial_used_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS trial_ledger (
+    telegram_id BIGINT PRIMARY KEY,
+    used_at     TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO trial_ledger (telegram_id, used_at)
+SELECT telegram_id, COALESCE(created_at, CURRENT_TIMESTAMP)
+FROM customer
+WHERE telegram_id IS NOT NULL
+  AND subscription_link IS NOT NULL
+ON CONFLICT (telegram_id) DO NOTHING;
+
+COMMIT;
@@ -0,0 +1 @@
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS link_reset_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1 @@
+ALTER TABLE customer DROP COLUMN IF EXISTS archived_at;
@@ -0,0 +1 @@
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS panel_id VARCHAR(64);
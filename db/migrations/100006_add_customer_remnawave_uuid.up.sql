@@ -0,0 +1 @@
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS remnawave_uuid UUID;
@@ -0,0 +1,5 @@
+ALTER TABLE customer
+    DROP COLUMN IF EXISTS username,
+    DROP COLUMN IF EXISTS first_name,
+    DROP COLUMN IF EXISTS last_name,
+    DROP COLUMN IF EXISTS is_premium;
@@ -0,0 +1,5 @@
+ALTER TABLE customer
+    ADD COLUMN IF NOT EXISTS username   VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS first_name VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS last_name  VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS is_premium BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS notification_log (
+    id          BIGSERIAL PRIMARY KEY,
+    customer_id BIGINT                   NOT NULL REFERENCES customer (id) ON DELETE CASCADE,
+    type        VARCHAR(64)              NOT NULL,
+    period      TIMESTAMP WITH TIME ZONE NOT NULL,
+    sent_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (customer_id, type, period)
+);
+
+COMMIT;
@@ -0,0 +1,18 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS campaign_delivery (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign         VARCHAR(64)              NOT NULL,
+    customer_id      BIGINT                   NOT NULL REFERENCES customer (id) ON DELETE CASCADE,
+    period           TIMESTAMP WITH TIME ZONE NOT NULL,
+    discount_percent INTEGER                  NOT NULL DEFAULT 0,
+    discount_until   TIMESTAMP WITH TIME ZONE,
+    sent_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    converted_at     TIMESTAMP WITH TIME ZONE,
+    purchase_id      BIGINT REFERENCES purchase (id) ON DELETE SET NULL,
+    UNIQUE (campaign, customer_id, period)
+);
+
+CREATE INDEX IF NOT EXISTS idx_campaign_delivery_customer_id ON campaign_delivery (customer_id, sent_at);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE IF EXISTS broadcast_delivery;
+
+ALTER TABLE broadcast
+    DROP COLUMN IF EXISTS total_count,
+    DROP COLUMN IF EXISTS sent_count,
+    DROP COLUMN IF EXISTS failed_count,
+    DROP COLUMN IF EXISTS finished_at;
+
+COMMIT;
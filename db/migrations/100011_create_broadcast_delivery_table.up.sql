@@ -0,0 +1,24 @@
+BEGIN;
+
+ALTER TABLE broadcast
+    ADD COLUMN IF NOT EXISTS total_count  INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS sent_count   INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS failed_count INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS finished_at  TIMESTAMP WITH TIME ZONE;
+
+-- broadcasts interrupted before the queue existed have no recipients to resume
+UPDATE broadcast SET status = 'failed' WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS broadcast_delivery (
+    id           BIGSERIAL PRIMARY KEY,
+    broadcast_id BIGINT      NOT NULL REFERENCES broadcast (id) ON DELETE CASCADE,
+    telegram_id  BIGINT      NOT NULL,
+    status       VARCHAR(20) NOT NULL DEFAULT 'pending',
+    error        TEXT,
+    sent_at      TIMESTAMP WITH TIME ZONE,
+    UNIQUE (broadcast_id, telegram_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_delivery_pending ON broadcast_delivery (broadcast_id, id) WHERE status = 'pending';
+
+COMMIT;
@@ -0,0 +1,8 @@
+DELETE FROM broadcast WHERE status = 'draft';
+
+ALTER TABLE broadcast
+    DROP COLUMN IF EXISTS source_chat_id,
+    DROP COLUMN IF EXISTS source_message_ids,
+    DROP COLUMN IF EXISTS media_group_id,
+    DROP COLUMN IF EXISTS buttons,
+    DROP COLUMN IF EXISTS compose_step;
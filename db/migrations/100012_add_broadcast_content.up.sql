@@ -0,0 +1,6 @@
+ALTER TABLE broadcast
+    ADD COLUMN IF NOT EXISTS source_chat_id     BIGINT,
+    ADD COLUMN IF NOT EXISTS source_message_ids BIGINT[],
+    ADD COLUMN IF NOT EXISTS media_group_id     VARCHAR(64),
+    ADD COLUMN IF NOT EXISTS buttons            JSONB,
+    ADD COLUMN IF NOT EXISTS compose_step       VARCHAR(20);
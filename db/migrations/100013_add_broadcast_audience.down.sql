@@ -0,0 +1 @@
+ALTER TABLE broadcast DROP COLUMN IF EXISTS audience;
@@ -0,0 +1 @@
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS audience TEXT;
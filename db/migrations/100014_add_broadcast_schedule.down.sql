@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_broadcast_scheduled;
+
+ALTER TABLE broadcast
+    DROP COLUMN IF EXISTS progress_message_id,
+    DROP COLUMN IF EXISTS scheduled_at;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE broadcast
+    ADD COLUMN IF NOT EXISTS scheduled_at        TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS progress_message_id BIGINT;
+
+CREATE INDEX IF NOT EXISTS idx_broadcast_scheduled ON broadcast (scheduled_at) WHERE status = 'scheduled';
+
+COMMIT;
@@ -0,0 +1 @@
+ALTER TABLE purchase DROP COLUMN IF EXISTS campaign_delivery_id;
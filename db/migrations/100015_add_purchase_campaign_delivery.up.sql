@@ -0,0 +1 @@
+ALTER TABLE purchase ADD COLUMN IF NOT EXISTS campaign_delivery_id BIGINT REFERENCES campaign_delivery (id) ON DELETE SET NULL;
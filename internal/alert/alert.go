@@ -0,0 +1,188 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"html"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Type groups the alerts, every type is rate limited on its own.
+type Type string
+
+const (
+	Provisioning     Type = "provisioning"
+	PanelUnavailable Type = "panel_unavailable"
+	ProviderError    Type = "provider_error"
+	Migration        Type = "migration"
+	Database         Type = "database"
+	Purchase         Type = "purchase"
+)
+
+var titles = map[Type]string{
+	Provisioning:     "❌ Provisioning failed",
+	PanelUnavailable: "🔴 Remnawave",
+	ProviderError:    "⚠️ Payment provider error",
+	Migration:        "🛠 Migration problem",
+	Database:         "🗄 Database unavailable",
+	Purchase:         "💰 Purchase",
+}
+
+const (
+	maxDigestLines = 20
+	maxLineLength  = 500
+	// maxMessageLength is the limit of a telegram message, the digest lines that don't fit are only counted
+	maxMessageLength = 4096
+	sendTimeout      = 10 * time.Second
+)
+
+var alerter *Alerter
+
+// Alerter sends the alerts to ALERT_CHAT_ID. The first alert of a type is sent right away, the next ones
+// within ALERT_DIGEST_MINUTES are collected and sent as a single digest at the end of the interval.
+type Alerter struct {
+	telegramBot *bot.Bot
+	chatID      int64
+	interval    time.Duration
+
+	mu     sync.Mutex
+	states map[Type]*state
+}
+
+type state struct {
+	sentAt    time.Time
+	scheduled bool
+	total     int
+	lines     []string
+	counts    map[string]int
+}
+
+// Init enables the alerts if ALERT_CHAT_ID is set. Until then Send only drops the alerts,
+// the events are logged by the callers anyway.
+func Init(telegramBot *bot.Bot) {
+	if config.AlertChatID() == 0 {
+		return
+	}
+	alerter = &Alerter{
+		telegramBot: telegramBot,
+		chatID:      config.AlertChatID(),
+		interval:    config.AlertDigestInterval(),
+		states:      make(map[Type]*state),
+	}
+}
+
+// Send alerts the ops chat. The text is plain, it is escaped and cut to a reasonable length.
+func Send(alertType Type, text string) {
+	if alerter == nil {
+		return
+	}
+	alerter.send(alertType, truncate(text))
+}
+
+// Sendf is Send with a formatted text.
+func Sendf(alertType Type, format string, args ...any) {
+	Send(alertType, fmt.Sprintf(format, args...))
+}
+
+// SendNow sends the alert and waits until telegram accepts it, bypassing the rate limiting. It is meant for
+// fatal errors right before the process exits, when an asynchronous alert would be lost.
+func SendNow(alertType Type, text string) {
+	if alerter == nil {
+		return
+	}
+	alerter.deliver(fmt.Sprintf("<b>%s</b>\n\n%s", titles[alertType], html.EscapeString(truncate(text))))
+}
+
+func (a *Alerter) send(alertType Type, text string) {
+	a.mu.Lock()
+	s, ok := a.states[alertType]
+	if !ok {
+		s = &state{}
+		a.states[alertType] = s
+	}
+
+	now := time.Now()
+	if !s.scheduled && now.Sub(s.sentAt) >= a.interval {
+		s.sentAt = now
+		a.mu.Unlock()
+		// the alert is raised on the hot path, e.g. inside a panel request, so it must not wait for telegram
+		go a.deliver(fmt.Sprintf("<b>%s</b>\n\n%s", titles[alertType], html.EscapeString(text)))
+		return
+	}
+	defer a.mu.Unlock()
+
+	s.total++
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	if _, seen := s.counts[text]; seen || len(s.lines) < maxDigestLines {
+		if !seen {
+			s.lines = append(s.lines, text)
+		}
+		s.counts[text]++
+	}
+	if !s.scheduled {
+		s.scheduled = true
+		time.AfterFunc(time.Until(s.sentAt.Add(a.interval)), func() { a.flush(alertType) })
+	}
+}
+
+// flush sends the digest of the alerts collected since the last message of the type.
+func (a *Alerter) flush(alertType Type) {
+	a.mu.Lock()
+	s := a.states[alertType]
+	total, lines, counts := s.total, s.lines, s.counts
+	s.sentAt = time.Now()
+	s.scheduled, s.total, s.lines, s.counts = false, 0, nil, nil
+	a.mu.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%s</b> · %d more in the last %s", titles[alertType], total, a.interval)
+	// room for the "…and N more" line
+	limit := maxMessageLength - 64
+	shown := 0
+	for _, line := range lines {
+		entry := "\n\n" + html.EscapeString(line)
+		if counts[line] > 1 {
+			entry += fmt.Sprintf(" <i>(×%d)</i>", counts[line])
+		}
+		if utf8.RuneCountInString(sb.String())+utf8.RuneCountInString(entry) > limit {
+			break
+		}
+		sb.WriteString(entry)
+		shown += counts[line]
+	}
+	if total > shown {
+		fmt.Fprintf(&sb, "\n\n…and %d more", total-shown)
+	}
+	a.deliver(sb.String())
+}
+
+func (a *Alerter) deliver(text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	_, err := a.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    a.chatID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+	})
+	if err != nil {
+		slog.Error("Failed to send alert", "error", err)
+	}
+}
+
+func truncate(text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxLineLength {
+		return text
+	}
+	return string(runes[:maxLineLength]) + "…"
+}
@@ -0,0 +1,161 @@
+package broadcast
+
+import (
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"remnawave-tg-shop-bot/internal/database"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Сегменты аудитории рассылки
+const (
+	SegmentActive    = "active"
+	SegmentExpired   = "expired"
+	SegmentTrial     = "trial"
+	SegmentNeverPaid = "never_paid"
+	SegmentPaid      = "paid"
+)
+
+var segments = []string{SegmentActive, SegmentExpired, SegmentTrial, SegmentNeverPaid, SegmentPaid}
+
+// AudienceHelp описывает синтаксис фильтра аудитории для админа
+const AudienceHelp = "Фильтр состоит из условий через пробел, все условия должны выполняться:\n" +
+	"`active`, `expired` — подписка активна или истекла\n" +
+	"`trial` — пользовались только пробным периодом, `never_paid` — ни разу не платили, `paid` — платили\n" +
+	"`lang=ru,en` — язык\n" +
+	"`tariff=3,6` — тариф последней покупки в месяцах\n" +
+	"`expiring=3` — подписка истекает в ближайшие N дней\n" +
+	"`referrer=123456789` — приглашены пользователем с этим telegram id\n\n" +
+	"Например: `expired paid lang=ru`. `all` — все пользователи."
+
+// Audience выбирает получателей рассылки. Условия строятся только из известных полей с параметрами запроса,
+// поэтому фильтр админа не может изменить SQL.
+type Audience struct {
+	Segments     []string
+	Languages    []string
+	Tariffs      []int
+	ExpiringDays int
+	ReferrerID   int64
+}
+
+// ParseAudience разбирает фильтр аудитории, например "active lang=ru tariff=3". Пустой фильтр или "all" — все пользователи.
+func ParseAudience(filter string) (*Audience, error) {
+	audience := &Audience{}
+	for _, token := range strings.Fields(strings.ToLower(filter)) {
+		key, value, found := strings.Cut(token, "=")
+		if !found {
+			switch {
+			case key == "all":
+			case slices.Contains(segments, key):
+				if !slices.Contains(audience.Segments, key) {
+					audience.Segments = append(audience.Segments, key)
+				}
+			default:
+				return nil, fmt.Errorf("неизвестный сегмент %q", key)
+			}
+			continue
+		}
+
+		values := strings.Split(value, ",")
+		switch key {
+		case "lang":
+			for _, lang := range values {
+				if lang == "" {
+					return nil, fmt.Errorf("пустой язык в %q", token)
+				}
+				audience.Languages = append(audience.Languages, lang)
+			}
+		case "tariff":
+			for _, v := range values {
+				months, err := strconv.Atoi(v)
+				if err != nil || months <= 0 {
+					return nil, fmt.Errorf("тариф должен быть числом месяцев: %q", v)
+				}
+				audience.Tariffs = append(audience.Tariffs, months)
+			}
+		case "expiring":
+			days, err := strconv.Atoi(value)
+			if err != nil || days <= 0 {
+				return nil, fmt.Errorf("expiring должен быть положительным числом дней: %q", value)
+			}
+			audience.ExpiringDays = days
+		case "referrer":
+			referrerID, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("referrer должен быть telegram id: %q", value)
+			}
+			audience.ReferrerID = referrerID
+		default:
+			return nil, fmt.Errorf("неизвестное условие %q", key)
+		}
+	}
+	return audience, nil
+}
+
+// String возвращает фильтр в виде, который снова разбирается ParseAudience
+func (a *Audience) String() string {
+	var parts []string
+	parts = append(parts, a.Segments...)
+	if len(a.Languages) > 0 {
+		parts = append(parts, "lang="+strings.Join(a.Languages, ","))
+	}
+	if len(a.Tariffs) > 0 {
+		tariffs := make([]string, len(a.Tariffs))
+		for i, months := range a.Tariffs {
+			tariffs[i] = strconv.Itoa(months)
+		}
+		parts = append(parts, "tariff="+strings.Join(tariffs, ","))
+	}
+	if a.ExpiringDays > 0 {
+		parts = append(parts, fmt.Sprintf("expiring=%d", a.ExpiringDays))
+	}
+	if a.ReferrerID != 0 {
+		parts = append(parts, fmt.Sprintf("referrer=%d", a.ReferrerID))
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, " ")
+}
+
+// conditions возвращает условия выборки из таблицы customer
+func (a *Audience) conditions(excludeAdminID int64) sq.And {
+	now := time.Now()
+	conditions := sq.And{sq.NotEq{"telegram_id": excludeAdminID}, sq.NotEq{"telegram_id": nil}}
+
+	hasPaidPurchase := sq.Expr("EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", database.PurchaseStatusPaid)
+	hasNoPaidPurchase := sq.Expr("NOT EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", database.PurchaseStatusPaid)
+	for _, segment := range a.Segments {
+		switch segment {
+		case SegmentActive:
+			conditions = append(conditions, sq.Gt{"expire_at": now})
+		case SegmentExpired:
+			conditions = append(conditions, sq.LtOrEq{"expire_at": now})
+		case SegmentTrial:
+			conditions = append(conditions, sq.NotEq{"trial_used_at": nil}, hasNoPaidPurchase)
+		case SegmentNeverPaid:
+			conditions = append(conditions, hasNoPaidPurchase)
+		case SegmentPaid:
+			conditions = append(conditions, hasPaidPurchase)
+		}
+	}
+	if len(a.Languages) > 0 {
+		conditions = append(conditions, sq.Eq{"language": a.Languages})
+	}
+	if len(a.Tariffs) > 0 {
+		conditions = append(conditions, sq.Expr(
+			"(SELECT p.month FROM purchase p WHERE p.customer_id = customer.id AND p.status = ? ORDER BY p.paid_at DESC LIMIT 1) = ANY(?)",
+			database.PurchaseStatusPaid, a.Tariffs))
+	}
+	if a.ExpiringDays > 0 {
+		conditions = append(conditions, sq.Gt{"expire_at": now}, sq.LtOrEq{"expire_at": now.AddDate(0, 0, a.ExpiringDays)})
+	}
+	if a.ReferrerID != 0 {
+		conditions = append(conditions, sq.Expr(
+			"EXISTS (SELECT 1 FROM referral r WHERE r.referee_id = customer.telegram_id AND r.referrer_id = ?)", a.ReferrerID))
+	}
+	return conditions
+}
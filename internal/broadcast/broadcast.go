@@ -2,26 +2,88 @@ package broadcast
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/go-telegram/bot/models"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"strings"
 	"time"
 )
 
 // Статусы для сообщений трансляции
 const (
-	BroadcastStatusPending = "pending"
-	BroadcastStatusSent    = "sent"
-	BroadcastStatusFailed  = "failed"
+	BroadcastStatusDraft     = "draft"
+	BroadcastStatusScheduled = "scheduled"
+	BroadcastStatusPending   = "pending"
+	BroadcastStatusSent      = "sent"
+	BroadcastStatusFailed    = "failed"
+	BroadcastStatusStopped   = "stopped"
 )
 
-// Broadcast представляет структуру записи в таблице трансляций
+// Шаги составления черновика: бот ждет от админа сообщение для рассылки, кнопки, фильтр аудитории
+// или время отправки
+const (
+	ComposeStepMessage  = "message"
+	ComposeStepButtons  = "buttons"
+	ComposeStepAudience = "audience"
+	ComposeStepSchedule = "schedule"
+)
+
+// ErrNotDraft возвращается при попытке отправить рассылку, которая уже не является черновиком или запланированной
+var ErrNotDraft = errors.New("broadcast is not a draft")
+
+// Broadcast представляет структуру записи в таблице трансляций. Рассылка либо содержит текст Message,
+// либо копирует сообщения SourceMessageIDs из чата админа, сохраняя медиа и форматирование.
 type Broadcast struct {
-	ID      int64     `db:"id"`
-	SenderID int64    `db:"sender_id"`
-	Message  string   `db:"message"`
-	SentAt   time.Time `db:"sent_at"`
-	Status   string   `db:"status"`
+	ID               int64                           `db:"id"`
+	SenderID         int64                           `db:"sender_id"`
+	Message          string                          `db:"message"`
+	SentAt           time.Time                       `db:"sent_at"`
+	Status           string                          `db:"status"`
+	SourceChatID     *int64                          `db:"source_chat_id"`
+	SourceMessageIDs []int64                         `db:"source_message_ids"`
+	MediaGroupID     *string                         `db:"media_group_id"`
+	Buttons          [][]models.InlineKeyboardButton `db:"buttons"`
+	ComposeStep      *string                         `db:"compose_step"`
+	Audience         *string                         `db:"audience"`
+	ScheduledAt      *time.Time                      `db:"scheduled_at"`
+	// ProgressMessageID — сообщение админу с ходом рассылки, которое обновляет обработчик очереди
+	ProgressMessageID *int64 `db:"progress_message_id"`
+}
+
+// IsAlbum сообщает, копирует ли рассылка альбом. К альбому нельзя прикрепить кнопки.
+func (b *Broadcast) IsAlbum() bool {
+	return b.MediaGroupID != nil
+}
+
+// ReplyMarkup возвращает кнопки рассылки или nil, если их нет
+func (b *Broadcast) ReplyMarkup() models.ReplyMarkup {
+	if len(b.Buttons) == 0 {
+		return nil
+	}
+	return models.InlineKeyboardMarkup{InlineKeyboard: b.Buttons}
+}
+
+var broadcastColumns = []string{"id", "sender_id", "message", "sent_at", "status",
+	"source_chat_id", "source_message_ids", "media_group_id", "buttons", "compose_step", "audience", "scheduled_at", "progress_message_id"}
+
+func scanBroadcast(row pgx.Row, broadcast *Broadcast) error {
+	var buttons []byte
+	err := row.Scan(&broadcast.ID, &broadcast.SenderID, &broadcast.Message, &broadcast.SentAt, &broadcast.Status,
+		&broadcast.SourceChatID, &broadcast.SourceMessageIDs, &broadcast.MediaGroupID, &buttons, &broadcast.ComposeStep, &broadcast.Audience,
+		&broadcast.ScheduledAt, &broadcast.ProgressMessageID)
+	if err != nil {
+		return err
+	}
+	if buttons != nil {
+		if err := json.Unmarshal(buttons, &broadcast.Buttons); err != nil {
+			return fmt.Errorf("failed to decode broadcast buttons: %w", err)
+		}
+	}
+	return nil
 }
 
 // BroadcastRepository предоставляет методы для работы с таблицей трансляций
@@ -80,36 +142,519 @@ func (br *BroadcastRepository) UpdateStatus(ctx context.Context, id int64, statu
 	return nil
 }
 
-// GetAllSubscribers возвращает список всех подписчиков из таблицы customer
-func (br *BroadcastRepository) GetAllSubscribers(ctx context.Context, excludeAdminID int64) ([]int64, error) {
-	buildSelect := sq.Select("telegram_id").
+// Статусы доставки рассылки отдельному получателю
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+)
+
+// Delivery представляет получателя рассылки в таблице broadcast_delivery
+type Delivery struct {
+	ID          int64  `db:"id"`
+	BroadcastID int64  `db:"broadcast_id"`
+	TelegramID  int64  `db:"telegram_id"`
+	Status      string `db:"status"`
+}
+
+// Enqueue ставит черновик или запланированную рассылку в очередь на отправку ее аудитории, кроме админа
+func (br *BroadcastRepository) Enqueue(ctx context.Context, id int64, excludeAdminID int64) (int, error) {
+	tx, err := br.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql, args, err := sq.Update("broadcast").
+		Set("status", BroadcastStatusPending).
+		Set("compose_step", nil).
+		Set("sent_at", time.Now()).
+		Where(sq.Eq{"id": id, "status": []string{BroadcastStatusDraft, BroadcastStatusScheduled}}).
+		Suffix("RETURNING audience").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build update broadcast status query: %w", err)
+	}
+	var filter *string
+	if err := tx.QueryRow(ctx, sql, args...).Scan(&filter); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNotDraft
+		}
+		return 0, fmt.Errorf("failed to update broadcast status: %w", err)
+	}
+	audience, err := parseStoredAudience(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	total, err := enqueue(ctx, tx, id, audience, excludeAdminID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return total, nil
+}
+
+// CountAudience возвращает число получателей, которым будет отправлена рассылка
+func (br *BroadcastRepository) CountAudience(ctx context.Context, audience *Audience, excludeAdminID int64) (int, error) {
+	sql, args, err := sq.Select("COUNT(*)").
 		From("customer").
-		Where(sq.NotEq{"telegram_id": excludeAdminID}).
-		PlaceholderFormat(sq.Dollar)
+		Where(audience.conditions(excludeAdminID)).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build count audience query: %w", err)
+	}
+
+	var count int
+	if err := br.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count audience: %w", err)
+	}
+	return count, nil
+}
+
+// ParsedAudience возвращает аудиторию черновика, без фильтра — всех пользователей
+func (b *Broadcast) ParsedAudience() (*Audience, error) {
+	return parseStoredAudience(b.Audience)
+}
+
+func parseStoredAudience(filter *string) (*Audience, error) {
+	if filter == nil {
+		return &Audience{}, nil
+	}
+	audience, err := ParseAudience(*filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse broadcast audience: %w", err)
+	}
+	return audience, nil
+}
+
+// enqueue добавляет получателей рассылки в очередь и сохраняет их количество
+func enqueue(ctx context.Context, tx pgx.Tx, id int64, audience *Audience, excludeAdminID int64) (int, error) {
+	sql, args, err := sq.Insert("broadcast_delivery").
+		Columns("broadcast_id", "telegram_id").
+		Select(sq.Select().
+			Column(sq.Expr("?::bigint", id)).
+			Column("telegram_id").
+			From("customer").
+			Where(audience.conditions(excludeAdminID))).
+		Suffix("ON CONFLICT (broadcast_id, telegram_id) DO NOTHING").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build insert broadcast recipients query: %w", err)
+	}
+	result, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert broadcast recipients: %w", err)
+	}
+	total := int(result.RowsAffected())
+
+	sql, args, err = sq.Update("broadcast").
+		Set("total_count", total).
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build update broadcast total query: %w", err)
+	}
+	if _, err := tx.Exec(ctx, sql, args...); err != nil {
+		return 0, fmt.Errorf("failed to update broadcast total: %w", err)
+	}
+	return total, nil
+}
+
+// CreateDraft начинает составление новой рассылки админом. Прежний черновик админа удаляется.
+func (br *BroadcastRepository) CreateDraft(ctx context.Context, senderID int64) (*Broadcast, error) {
+	sql, args, err := sq.Delete("broadcast").
+		Where(sq.Eq{"sender_id": senderID, "status": BroadcastStatusDraft}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build delete drafts query: %w", err)
+	}
+	if _, err := br.pool.Exec(ctx, sql, args...); err != nil {
+		return nil, fmt.Errorf("failed to delete drafts: %w", err)
+	}
+
+	sql, args, err = sq.Insert("broadcast").
+		Columns("sender_id", "message", "status", "compose_step").
+		Values(senderID, "", BroadcastStatusDraft, ComposeStepMessage).
+		Suffix("RETURNING " + strings.Join(broadcastColumns, ", ")).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build insert draft query: %w", err)
+	}
+
+	var broadcast Broadcast
+	if err := scanBroadcast(br.pool.QueryRow(ctx, sql, args...), &broadcast); err != nil {
+		return nil, fmt.Errorf("failed to insert draft: %w", err)
+	}
+	return &broadcast, nil
+}
+
+// FindDraft возвращает черновик рассылки админа или nil
+func (br *BroadcastRepository) FindDraft(ctx context.Context, senderID int64) (*Broadcast, error) {
+	return br.findOne(ctx, sq.Eq{"sender_id": senderID, "status": BroadcastStatusDraft})
+}
+
+// FindByID возвращает рассылку по идентификатору или nil
+func (br *BroadcastRepository) FindByID(ctx context.Context, id int64) (*Broadcast, error) {
+	return br.findOne(ctx, sq.Eq{"id": id})
+}
+
+func (br *BroadcastRepository) findOne(ctx context.Context, conditions sq.Sqlizer) (*Broadcast, error) {
+	sql, args, err := sq.Select(broadcastColumns...).
+		From("broadcast").
+		Where(conditions).
+		OrderBy("id DESC").
+		Limit(1).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select broadcast query: %w", err)
+	}
+
+	var broadcast Broadcast
+	if err := scanBroadcast(br.pool.QueryRow(ctx, sql, args...), &broadcast); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query broadcast: %w", err)
+	}
+	return &broadcast, nil
+}
+
+// UpdateDraft сохраняет содержимое и шаг составления черновика
+func (br *BroadcastRepository) UpdateDraft(ctx context.Context, broadcast *Broadcast) error {
+	var buttons []byte
+	if len(broadcast.Buttons) > 0 {
+		var err error
+		if buttons, err = json.Marshal(broadcast.Buttons); err != nil {
+			return fmt.Errorf("failed to encode broadcast buttons: %w", err)
+		}
+	}
+
+	sql, args, err := sq.Update("broadcast").
+		Set("message", broadcast.Message).
+		Set("source_chat_id", broadcast.SourceChatID).
+		Set("source_message_ids", broadcast.SourceMessageIDs).
+		Set("media_group_id", broadcast.MediaGroupID).
+		Set("buttons", buttons).
+		Set("compose_step", broadcast.ComposeStep).
+		Set("audience", broadcast.Audience).
+		Where(sq.Eq{"id": broadcast.ID, "status": BroadcastStatusDraft}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update draft query: %w", err)
+	}
+	if _, err := br.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to update draft: %w", err)
+	}
+	return nil
+}
+
+// AddSourceMessage сохраняет в черновике сообщение админа для рассылки. Сообщения альбома приходят
+// отдельными обновлениями и обрабатываются параллельно, поэтому они дописываются одним запросом:
+// первое заменяет содержимое черновика, остальные с тем же media_group_id добавляются к нему.
+// Возвращает nil, если черновик не ждет этого сообщения.
+func (br *BroadcastRepository) AddSourceMessage(ctx context.Context, id int64, chatID int64, messageID int64, mediaGroupID *string, text string) (*Broadcast, error) {
+	awaitsMessage := sq.Eq{"compose_step": ComposeStepMessage}
+	conditions := sq.Or{awaitsMessage}
+	if mediaGroupID != nil {
+		conditions = append(conditions, sq.Eq{"media_group_id": *mediaGroupID})
+	}
+
+	sql, args, err := sq.Update("broadcast").
+		Set("source_chat_id", chatID).
+		Set("source_message_ids", sq.Expr("CASE WHEN compose_step = ? THEN ARRAY[?::bigint] ELSE array_append(source_message_ids, ?::bigint) END",
+			ComposeStepMessage, messageID, messageID)).
+		Set("message", sq.Expr("CASE WHEN compose_step = ? THEN ? ELSE message END", ComposeStepMessage, text)).
+		Set("media_group_id", mediaGroupID).
+		Set("buttons", nil).
+		Set("compose_step", nil).
+		Where(sq.And{sq.Eq{"id": id, "status": BroadcastStatusDraft}, conditions}).
+		Suffix("RETURNING " + strings.Join(broadcastColumns, ", ")).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build add source message query: %w", err)
+	}
+
+	var broadcast Broadcast
+	if err := scanBroadcast(br.pool.QueryRow(ctx, sql, args...), &broadcast); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to add source message: %w", err)
+	}
+	return &broadcast, nil
+}
+
+// Schedule откладывает отправку черновика до времени at. Запланированные рассылки хранятся в базе
+// и ставятся в очередь обработчиком, поэтому переживают перезапуск бота.
+func (br *BroadcastRepository) Schedule(ctx context.Context, id int64, at time.Time) error {
+	sql, args, err := sq.Update("broadcast").
+		Set("status", BroadcastStatusScheduled).
+		Set("scheduled_at", at).
+		Set("compose_step", nil).
+		Where(sq.Eq{"id": id, "status": []string{BroadcastStatusDraft, BroadcastStatusScheduled}}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build schedule broadcast query: %w", err)
+	}
+	result, err := br.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("failed to schedule broadcast: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotDraft
+	}
+	return nil
+}
 
-	sql, args, err := buildSelect.ToSql()
+// Cancel удаляет черновик или запланированную рассылку. Возвращает false, если рассылка уже началась.
+func (br *BroadcastRepository) Cancel(ctx context.Context, id int64) (bool, error) {
+	sql, args, err := sq.Delete("broadcast").
+		Where(sq.Eq{"id": id, "status": []string{BroadcastStatusDraft, BroadcastStatusScheduled}}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build delete broadcast query: %w", err)
+	}
+	result, err := br.pool.Exec(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build select subscribers query: %w", err)
+		return false, fmt.Errorf("failed to delete broadcast: %w", err)
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// Stop останавливает идущую рассылку: оставшиеся получатели не получат сообщение.
+// Возвращает false, если рассылка уже завершена.
+func (br *BroadcastRepository) Stop(ctx context.Context, id int64) (bool, error) {
+	sql, args, err := sq.Update("broadcast").
+		Set("status", BroadcastStatusStopped).
+		Where(sq.Eq{"id": id, "status": BroadcastStatusPending}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build stop broadcast query: %w", err)
+	}
+	result, err := br.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to stop broadcast: %w", err)
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// SetProgressMessage сохраняет сообщение админу, в котором показывается ход рассылки
+func (br *BroadcastRepository) SetProgressMessage(ctx context.Context, id int64, messageID int64) error {
+	sql, args, err := sq.Update("broadcast").
+		Set("progress_message_id", messageID).
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update progress message query: %w", err)
+	}
+	if _, err := br.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to update progress message: %w", err)
+	}
+	return nil
+}
+
+// FindScheduled возвращает запланированные рассылки в порядке времени отправки
+func (br *BroadcastRepository) FindScheduled(ctx context.Context) ([]Broadcast, error) {
+	return br.findAll(ctx, sq.Eq{"status": BroadcastStatusScheduled}, "scheduled_at")
+}
+
+// FindDueScheduled возвращает запланированные рассылки, время отправки которых наступило
+func (br *BroadcastRepository) FindDueScheduled(ctx context.Context, now time.Time) ([]Broadcast, error) {
+	return br.findAll(ctx, sq.And{sq.Eq{"status": BroadcastStatusScheduled}, sq.LtOrEq{"scheduled_at": now}}, "scheduled_at")
+}
+
+// FindPending возвращает незавершенные рассылки в порядке постановки в очередь
+func (br *BroadcastRepository) FindPending(ctx context.Context) ([]Broadcast, error) {
+	// остановленная рассылка тоже завершается обработчиком, если бот перезапустили до подсчета итогов
+	return br.findAll(ctx, sq.Or{
+		sq.Eq{"status": BroadcastStatusPending},
+		sq.Eq{"status": BroadcastStatusStopped, "finished_at": nil},
+	}, "id")
+}
+
+func (br *BroadcastRepository) findAll(ctx context.Context, conditions sq.Sqlizer, orderBy string) ([]Broadcast, error) {
+	sql, args, err := sq.Select(broadcastColumns...).
+		From("broadcast").
+		Where(conditions).
+		OrderBy(orderBy).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select broadcasts query: %w", err)
 	}
 
 	rows, err := br.pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query subscribers: %w", err)
+		return nil, fmt.Errorf("failed to query broadcasts: %w", err)
 	}
 	defer rows.Close()
 
-	var subscribers []int64
+	var broadcasts []Broadcast
 	for rows.Next() {
-		var telegramID int64
-		if err := rows.Scan(&telegramID); err != nil {
-			return nil, fmt.Errorf("failed to scan subscriber row: %w", err)
+		var broadcast Broadcast
+		if err := scanBroadcast(rows, &broadcast); err != nil {
+			return nil, fmt.Errorf("failed to scan broadcast row: %w", err)
 		}
-		subscribers = append(subscribers, telegramID)
+		broadcasts = append(broadcasts, broadcast)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating broadcast rows: %w", err)
+	}
+	return broadcasts, nil
+}
+
+// FindPendingDeliveries возвращает следующих получателей рассылки, которым сообщение еще не отправлялось.
+// У остановленной рассылки получателей больше нет.
+func (br *BroadcastRepository) FindPendingDeliveries(ctx context.Context, broadcastID int64, limit uint64) ([]Delivery, error) {
+	sql, args, err := sq.Select("id", "broadcast_id", "telegram_id", "status").
+		From("broadcast_delivery").
+		Where(sq.And{
+			sq.Eq{"broadcast_id": broadcastID, "status": DeliveryStatusPending},
+			sq.Expr("EXISTS (SELECT 1 FROM broadcast b WHERE b.id = broadcast_delivery.broadcast_id AND b.status = ?)", BroadcastStatusPending),
+		}).
+		OrderBy("id").
+		Limit(limit).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select pending deliveries query: %w", err)
 	}
 
+	rows, err := br.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var delivery Delivery
+		if err := rows.Scan(&delivery.ID, &delivery.BroadcastID, &delivery.TelegramID, &delivery.Status); err != nil {
+			return nil, fmt.Errorf("failed to scan delivery row: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating subscriber rows: %w", err)
+		return nil, fmt.Errorf("error iterating delivery rows: %w", err)
+	}
+	return deliveries, nil
+}
+
+// MarkDelivery сохраняет результат отправки сообщения получателю
+func (br *BroadcastRepository) MarkDelivery(ctx context.Context, id int64, status string, sendErr error) error {
+	buildUpdate := sq.Update("broadcast_delivery").
+		Set("status", status).
+		Set("sent_at", time.Now()).
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar)
+	if sendErr != nil {
+		buildUpdate = buildUpdate.Set("error", sendErr.Error())
+	}
+
+	sql, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update delivery query: %w", err)
+	}
+	if _, err := br.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+	return nil
+}
+
+// Progress — ход доставки рассылки
+type Progress struct {
+	Total  int
+	Sent   int
+	Failed int
+}
+
+// Remaining возвращает число получателей, которым сообщение еще не отправлено
+func (p Progress) Remaining() int {
+	return p.Total - p.Sent - p.Failed
+}
+
+// IsPending проверяет, что рассылка еще идет, т.е. ее не остановил админ
+func (br *BroadcastRepository) IsPending(ctx context.Context, id int64) (bool, error) {
+	sql, args, err := sq.Select().
+		Column(sq.Expr("status = ?", BroadcastStatusPending)).
+		From("broadcast").
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build select broadcast status query: %w", err)
 	}
+	var pending bool
+	if err := br.pool.QueryRow(ctx, sql, args...).Scan(&pending); err != nil {
+		return false, fmt.Errorf("failed to query broadcast status: %w", err)
+	}
+	return pending, nil
+}
 
-	return subscribers, nil
-}
\ No newline at end of file
+// Progress подсчитывает ход доставки рассылки
+func (br *BroadcastRepository) Progress(ctx context.Context, id int64) (Progress, error) {
+	var progress Progress
+	sql, args, err := sq.Select("COUNT(*)",
+		"COUNT(*) FILTER (WHERE status = 'sent')",
+		"COUNT(*) FILTER (WHERE status = 'failed')").
+		From("broadcast_delivery").
+		Where(sq.Eq{"broadcast_id": id}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return progress, fmt.Errorf("failed to build count deliveries query: %w", err)
+	}
+	if err := br.pool.QueryRow(ctx, sql, args...).Scan(&progress.Total, &progress.Sent, &progress.Failed); err != nil {
+		return progress, fmt.Errorf("failed to count deliveries: %w", err)
+	}
+	return progress, nil
+}
+
+// Finish подсчитывает итоги доставки, сохраняет их в записи рассылки и завершает ее. Рассылка считается
+// неудачной, если не доставлено ни одно сообщение; остановленная админом сохраняет свой статус.
+func (br *BroadcastRepository) Finish(ctx context.Context, id int64) (string, Progress, error) {
+	progress, err := br.Progress(ctx, id)
+	if err != nil {
+		return "", progress, err
+	}
+
+	status := BroadcastStatusSent
+	if progress.Failed > 0 && progress.Sent == 0 {
+		status = BroadcastStatusFailed
+	}
+
+	sql, args, err := sq.Update("broadcast").
+		Set("status", sq.Expr("CASE WHEN status = ? THEN ? ELSE status END", BroadcastStatusPending, status)).
+		Set("total_count", progress.Total).
+		Set("sent_count", progress.Sent).
+		Set("failed_count", progress.Failed).
+		Set("finished_at", time.Now()).
+		Where(sq.Eq{"id": id}).
+		Suffix("RETURNING status").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+	if err != nil {
+		return "", progress, fmt.Errorf("failed to build finish broadcast query: %w", err)
+	}
+	if err := br.pool.QueryRow(ctx, sql, args...).Scan(&status); err != nil {
+		return "", progress, fmt.Errorf("failed to finish broadcast: %w", err)
+	}
+	return status, progress, nil
+}
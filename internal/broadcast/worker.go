@@ -0,0 +1,290 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// pollInterval — как часто обработчик проверяет очередь на новые рассылки
+	pollInterval = 5 * time.Second
+	// rateLimitDelay ограничивает скорость отправки (29 сообщений в секунду максимум)
+	rateLimitDelay = 35 * time.Millisecond
+	batchSize      = 100
+)
+
+// CallbackStop — данные кнопки «Остановить» в сообщении с ходом рассылки, к ним добавляется ?id=
+const CallbackStop = "bc_stop"
+
+// Worker отправляет рассылки из очереди broadcast_delivery. Результат сохраняется по каждому получателю,
+// поэтому после перезапуска бота рассылка продолжается с того же места и не дублируется тем,
+// кто уже получил сообщение.
+type Worker struct {
+	repo        *BroadcastRepository
+	telegramBot *bot.Bot
+}
+
+// NewWorker создает обработчик очереди рассылок
+func NewWorker(repo *BroadcastRepository, telegramBot *bot.Bot) *Worker {
+	return &Worker{repo: repo, telegramBot: telegramBot}
+}
+
+// Run обрабатывает очередь до отмены контекста. Незавершенные рассылки продолжаются сразу при запуске,
+// запланированные ставятся в очередь, когда наступает их время.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.processPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startScheduled ставит в очередь запланированные рассылки, время отправки которых наступило
+func (w *Worker) startScheduled(ctx context.Context) {
+	broadcasts, err := w.repo.FindDueScheduled(ctx, time.Now())
+	if err != nil {
+		slog.Error("Error finding scheduled broadcasts", "error", err)
+		return
+	}
+
+	for _, broadcast := range broadcasts {
+		total, err := w.repo.Enqueue(ctx, broadcast.ID, broadcast.SenderID)
+		if errors.Is(err, ErrNotDraft) {
+			// рассылку отменили или отправили вручную
+			continue
+		}
+		if err != nil {
+			slog.Error("Error enqueueing scheduled broadcast", "broadcastId", broadcast.ID, "error", err)
+			continue
+		}
+		slog.Info("Scheduled broadcast started", "broadcastId", broadcast.ID, "recipients", total)
+	}
+}
+
+func (w *Worker) processPending(ctx context.Context) {
+	w.startScheduled(ctx)
+
+	broadcasts, err := w.repo.FindPending(ctx)
+	if err != nil {
+		slog.Error("Error finding pending broadcasts", "error", err)
+		return
+	}
+
+	for _, broadcast := range broadcasts {
+		if err := w.process(ctx, broadcast); err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Broadcast interrupted, it will be resumed on the next start", "broadcastId", broadcast.ID)
+				return
+			}
+			slog.Error("Error processing broadcast", "broadcastId", broadcast.ID, "error", err)
+		}
+	}
+}
+
+func (w *Worker) process(ctx context.Context, broadcast Broadcast) error {
+	slog.Info("Processing broadcast", "broadcastId", broadcast.ID)
+	for {
+		w.showProgress(ctx, &broadcast)
+		// длинная рассылка не должна задерживать запланированные: их время проверяется после каждой пачки
+		w.startScheduled(ctx)
+
+		deliveries, err := w.repo.FindPendingDeliveries(ctx, broadcast.ID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+
+		for _, delivery := range deliveries {
+			// «Остановить» должна срабатывать сразу, а не после всей пачки
+			pending, err := w.repo.IsPending(ctx, broadcast.ID)
+			if err != nil {
+				return err
+			}
+			if !pending {
+				break
+			}
+			if err := w.deliver(ctx, broadcast, delivery); err != nil {
+				return err
+			}
+		}
+	}
+
+	status, progress, err := w.repo.Finish(ctx, broadcast.ID)
+	if err != nil {
+		return err
+	}
+	slog.Info("Broadcast finished", "broadcastId", broadcast.ID, "status", status, "sent", progress.Sent, "failed", progress.Failed)
+
+	finished := fmt.Sprintf("✅ Рассылка #%d завершена", broadcast.ID)
+	if status == BroadcastStatusStopped {
+		finished = fmt.Sprintf("⏹ Рассылка #%d остановлена", broadcast.ID)
+	}
+	w.editProgress(ctx, broadcast, fmt.Sprintf("%s: отправлено %d из %d, ошибок %d",
+		finished, progress.Sent, progress.Total, progress.Failed), nil)
+
+	// Отправляем отчет администратору
+	summary := fmt.Sprintf(
+		"📊 Отчет о рассылке:\n\n"+
+			"✅ Успешно отправлено: %d\n"+
+			"❌ Ошибок при отправке: %d\n"+
+			"📨 Всего получателей: %d",
+		progress.Sent, progress.Failed, progress.Total)
+	if status == BroadcastStatusStopped {
+		summary += fmt.Sprintf("\n⏹ Остановлена, не отправлено: %d", progress.Remaining())
+	}
+
+	_, err = w.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: broadcast.SenderID,
+		Text:   summary,
+	})
+	if err != nil {
+		slog.Error("Error sending broadcast summary", "error", err)
+	}
+	return nil
+}
+
+// showProgress показывает админу ход рассылки с кнопкой «Остановить». Сообщение отправляется
+// при первом вызове и затем обновляется после каждой пачки получателей.
+func (w *Worker) showProgress(ctx context.Context, broadcast *Broadcast) {
+	progress, err := w.repo.Progress(ctx, broadcast.ID)
+	if err != nil {
+		slog.Error("Error counting broadcast progress", "broadcastId", broadcast.ID, "error", err)
+		return
+	}
+
+	text := fmt.Sprintf("📤 Рассылка #%d: отправлено %d из %d, ошибок %d",
+		broadcast.ID, progress.Sent, progress.Total, progress.Failed)
+	keyboard := models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{{Text: "⏹ Остановить", CallbackData: fmt.Sprintf("%s?id=%d", CallbackStop, broadcast.ID)}},
+	}}
+
+	if broadcast.ProgressMessageID != nil {
+		w.editProgress(ctx, *broadcast, text, keyboard)
+		return
+	}
+
+	message, err := w.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      broadcast.SenderID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		slog.Error("Error sending broadcast progress", "broadcastId", broadcast.ID, "error", err)
+		return
+	}
+	messageID := int64(message.ID)
+	if err := w.repo.SetProgressMessage(ctx, broadcast.ID, messageID); err != nil {
+		slog.Error("Error saving broadcast progress message", "broadcastId", broadcast.ID, "error", err)
+	}
+	broadcast.ProgressMessageID = &messageID
+}
+
+func (w *Worker) editProgress(ctx context.Context, broadcast Broadcast, text string, replyMarkup models.ReplyMarkup) {
+	if broadcast.ProgressMessageID == nil {
+		return
+	}
+	_, err := w.telegramBot.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      broadcast.SenderID,
+		MessageID:   int(*broadcast.ProgressMessageID),
+		Text:        text,
+		ReplyMarkup: replyMarkup,
+	})
+	// текст не меняется, пока не отправлено ни одно сообщение, Telegram отвечает на это ошибкой
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		slog.Error("Error editing broadcast progress", "broadcastId", broadcast.ID, "error", err)
+	}
+}
+
+// deliver отправляет сообщение получателю и сохраняет результат. Ошибка возвращается только при отмене
+// контекста или ошибке базы, тогда получатель остается в очереди.
+func (w *Worker) deliver(ctx context.Context, broadcast Broadcast, delivery Delivery) error {
+	for {
+		sendErr := Send(ctx, w.telegramBot, broadcast, delivery.TelegramID)
+		if sendErr != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Telegram просит подождать — повторяем отправку тому же получателю
+		var tooManyRequests *bot.TooManyRequestsError
+		if errors.As(sendErr, &tooManyRequests) {
+			if err := sleep(ctx, time.Duration(tooManyRequests.RetryAfter)*time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+
+		status := DeliveryStatusSent
+		if sendErr != nil {
+			slog.Error("Error sending broadcast to user", "userId", delivery.TelegramID, "error", sendErr)
+			status = DeliveryStatusFailed
+		}
+		// доставленное сообщение отмечается и при остановке бота, иначе получатель увидит его повторно
+		if err := w.repo.MarkDelivery(context.WithoutCancel(ctx), delivery.ID, status, sendErr); err != nil {
+			return err
+		}
+		return sleep(ctx, rateLimitDelay)
+	}
+}
+
+// Send отправляет рассылку в чат. Сообщения админа копируются через copyMessage, поэтому медиа,
+// форматирование и кнопки сохраняются; альбом копируется целиком через copyMessages.
+func Send(ctx context.Context, telegramBot *bot.Bot, broadcast Broadcast, chatID int64) error {
+	if broadcast.SourceChatID == nil || len(broadcast.SourceMessageIDs) == 0 {
+		_, err := telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:      chatID,
+			Text:        broadcast.Message,
+			ParseMode:   models.ParseModeHTML, // Поддержка HTML форматирования
+			ReplyMarkup: broadcast.ReplyMarkup(),
+		})
+		return err
+	}
+
+	if broadcast.IsAlbum() {
+		messageIDs := make([]int, len(broadcast.SourceMessageIDs))
+		for i, id := range broadcast.SourceMessageIDs {
+			messageIDs[i] = int(id)
+		}
+		slices.Sort(messageIDs)
+		_, err := telegramBot.CopyMessages(ctx, &bot.CopyMessagesParams{
+			ChatID:     chatID,
+			FromChatID: *broadcast.SourceChatID,
+			MessageIDs: messageIDs,
+		})
+		return err
+	}
+
+	_, err := telegramBot.CopyMessage(ctx, &bot.CopyMessageParams{
+		ChatID:      chatID,
+		FromChatID:  *broadcast.SourceChatID,
+		MessageID:   int(broadcast.SourceMessageIDs[0]),
+		ReplyMarkup: broadcast.ReplyMarkup(),
+	})
+	return err
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package channel
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"time"
+)
+
+type Service struct {
+	telegramBot        *bot.Bot
+	customerRepository *database.CustomerRepository
+	panels             *remnawave.Panels
+	translation        *translation.Manager
+}
+
+func NewService(telegramBot *bot.Bot, customerRepository *database.CustomerRepository, panels *remnawave.Panels, translation *translation.Manager) *Service {
+	return &Service{
+		telegramBot:        telegramBot,
+		customerRepository: customerRepository,
+		panels:             panels,
+		translation:        translation,
+	}
+}
+
+// IsMember reports whether the user is subscribed to the configured channel.
+// It always returns true when the channel gate is disabled.
+func (s *Service) IsMember(ctx context.Context, telegramId int64) (bool, error) {
+	if !config.IsChannelSubscriptionRequired() {
+		return true, nil
+	}
+
+	member, err := s.telegramBot.GetChatMember(ctx, &bot.GetChatMemberParams{
+		ChatID: config.ChannelID(),
+		UserID: telegramId,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get chat member: %w", err)
+	}
+
+	switch member.Type {
+	case models.ChatMemberTypeOwner, models.ChatMemberTypeAdministrator, models.ChatMemberTypeMember:
+		return true, nil
+	case models.ChatMemberTypeRestricted:
+		return member.Restricted != nil && member.Restricted.IsMember, nil
+	default:
+		return false, nil
+	}
+}
+
+// RevokeTrialsOfLeavers disables unpaid trials of users who left the channel.
+func (s *Service) RevokeTrialsOfLeavers(ctx context.Context) error {
+	customers, err := s.customerRepository.FindActiveTrialCustomers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find active trial customers: %w", err)
+	}
+
+	revoked := 0
+	for _, customer := range customers {
+		isMember, err := s.IsMember(ctx, customer.TelegramID)
+		if err != nil {
+			slog.Error("Error checking channel membership", "telegramId", customer.TelegramID, "error", err)
+			continue
+		}
+		if isMember {
+			continue
+		}
+
+		if err := s.panels.Get(customer.PanelID).DisableUser(ctx, customer.RemnawaveUUID, customer.TelegramID); err != nil {
+			slog.Error("Error disabling trial user", "telegramId", customer.TelegramID, "error", err)
+			continue
+		}
+
+		err = s.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{
+			"expire_at": time.Now(),
+		})
+		if err != nil {
+			slog.Error("Error updating customer", "customerId", customer.ID, "error", err)
+			continue
+		}
+		revoked++
+
+		keyboard := append(s.SubscribeKeyboard(customer.Language, ""), []models.InlineKeyboardButton{
+			{Text: s.translation.GetText(customer.Language, "buy_button"), CallbackData: "buy"},
+		})
+		_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:      customer.TelegramID,
+			Text:        s.translation.GetText(customer.Language, "trial_revoked_channel"),
+			ParseMode:   models.ParseModeHTML,
+			ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		})
+		if err != nil {
+			slog.Error("Error sending trial revoked message", "telegramId", customer.TelegramID, "error", err)
+		}
+	}
+
+	slog.Info("Channel membership recheck completed", "checked", len(customers), "revoked", revoked)
+	return nil
+}
+
+// SubscribeKeyboard builds the "Subscribe / Check" keyboard. The check button is omitted
+// when checkCallback is empty.
+func (s *Service) SubscribeKeyboard(langCode string, checkCallback string) [][]models.InlineKeyboardButton {
+	var keyboard [][]models.InlineKeyboardButton
+	if config.ChannelURL() != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: s.translation.GetText(langCode, "channel_subscribe_button"), URL: config.ChannelURL()},
+		})
+	}
+	if checkCallback != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: s.translation.GetText(langCode, "channel_check_button"), CallbackData: checkCallback},
+		})
+	}
+	return keyboard
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SegmentTrialNeverPaid is the customers whose trial ended Days ago without a paid purchase.
+	SegmentTrialNeverPaid = "trial_never_paid"
+	// SegmentExpired is the customers whose subscription expired Days ago.
+	SegmentExpired = "expired"
+)
+
+type CampaignConfig struct {
+	Name    string
+	Segment string
+	Days    int
+	// Discount is the personal discount in percent offered by the campaign, 0 means no discount.
+	Discount int
+	// DiscountDays is the number of days the discount is valid after the message is sent.
+	DiscountDays int
+}
+
+func Campaigns() []CampaignConfig {
+	return conf.campaigns
+}
+
+// initCampaigns reads the win-back campaigns from WINBACK_CAMPAIGNS, each configured by WINBACK_<NAME>_* variables.
+func initCampaigns() {
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("WINBACK_CAMPAIGNS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		conf.campaigns = append(conf.campaigns, readCampaign(name))
+	}
+}
+
+func readCampaign(name string) CampaignConfig {
+	prefix := "WINBACK_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	campaign := CampaignConfig{Name: name, DiscountDays: 7}
+
+	campaign.Segment = os.Getenv(prefix + "SEGMENT")
+	if campaign.Segment != SegmentTrialNeverPaid && campaign.Segment != SegmentExpired {
+		panic(fmt.Sprintf("%sSEGMENT .env variable must be either 'trial_never_paid' or 'expired'", prefix))
+	}
+
+	var err error
+	campaign.Days, err = strconv.Atoi(os.Getenv(prefix + "DAYS"))
+	if err != nil || campaign.Days <= 0 {
+		panic(fmt.Sprintf("%sDAYS .env variable must be a positive number", prefix))
+	}
+
+	if discount := os.Getenv(prefix + "DISCOUNT"); discount != "" {
+		campaign.Discount, err = strconv.Atoi(discount)
+		if err != nil || campaign.Discount < 0 || campaign.Discount >= 100 {
+			panic(fmt.Sprintf("%sDISCOUNT .env variable must be a percent from 0 to 99", prefix))
+		}
+	}
+
+	if discountDays := os.Getenv(prefix + "DISCOUNT_DAYS"); discountDays != "" {
+		campaign.DiscountDays, err = strconv.Atoi(discountDays)
+		if err != nil || campaign.DiscountDays <= 0 {
+			panic(fmt.Sprintf("%sDISCOUNT_DAYS .env variable must be a positive number", prefix))
+		}
+	}
+
+	return campaign
+}
@@ -4,8 +4,10 @@ import (
 	"github.com/joho/godotenv"
 	"log/slog"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type config struct {
@@ -17,6 +19,8 @@ type config struct {
 	remnawaveUrl           string
 	remnawaveToken         string
 	remnawaveMode          string
+	panels                 []PanelConfig
+	panelPlacement         string
 	databaseURL            string
 	cryptoPayURL           string
 	cryptoPayToken         string
@@ -28,7 +32,11 @@ type config struct {
 	trafficLimit           int
 	feedbackURL            string
 	channelURL             string
+	channelID              string
+	channelRequired        bool
+	channelRecheck         bool
 	serverStatusURL        string
+	nodeAlertsEnabled      bool
 	supportURL             string
 	tosURL                 string
 	isYookasaEnabled       bool
@@ -37,9 +45,33 @@ type config struct {
 	adminTelegramId        int64
 	trialDays              int
 	trialTrafficLimit      int
+	trialRequireUsername   bool
+	trialMaxTelegramId     int64
+	trafficLimitStrategy   string
+	trialTrafficStrategy   string
+	resetTrafficOnRenewal  bool
 	inboundUUIDs           map[string]string
+	allowedCountries       map[string]bool
 	referralDays           int
 	miniApp                string
+	linkResetCooldown      int
+	isWebhookEnabled       bool
+	webhookPort            int
+	webhookSecret          string
+	syncCron               string
+	remnawaveTimeout       int
+	remnawaveRetries       int
+	metricsAddr            string
+	notificationStages     []int
+	trafficThresholds      []int
+	campaigns              []CampaignConfig
+	defaultTimezone        string
+	notificationHourStart  int
+	notificationHourEnd    int
+	alertChatID            int64
+	alertDigestInterval    int
+	dailyReport            bool
+	weeklyReport           bool
 }
 
 var conf config
@@ -52,14 +84,112 @@ func GetMiniAppURL() string {
 	return conf.miniApp
 }
 
+func IsWebhookEnabled() bool {
+	return conf.isWebhookEnabled
+}
+
+func WebhookPort() int {
+	return conf.webhookPort
+}
+
+func WebhookSecret() string {
+	return conf.webhookSecret
+}
+
+func SyncCron() string {
+	return conf.syncCron
+}
+
+func RemnawaveTimeout() time.Duration {
+	return time.Duration(conf.remnawaveTimeout) * time.Second
+}
+
+func RemnawaveRetries() int {
+	return conf.remnawaveRetries
+}
+
+// MetricsAddr is the listen address of the metrics endpoint, empty if it is disabled.
+func MetricsAddr() string {
+	return conf.metricsAddr
+}
+
+// NotificationStages returns the days before the expiration of the subscription to remind about it,
+// sorted from the earliest stage. 0 is the day of expiration and negative stages are days after it.
+func NotificationStages() []int {
+	return conf.notificationStages
+}
+
+// TrafficThresholds returns the percents of the traffic limit to warn about, sorted from the highest.
+func TrafficThresholds() []int {
+	return conf.trafficThresholds
+}
+
+// DefaultTimezone is the timezone of the customers whose language doesn't suggest one.
+func DefaultTimezone() string {
+	return conf.defaultTimezone
+}
+
+// NotificationHours returns the local hours [start, end) in which notifications are delivered to the customers.
+func NotificationHours() (int, int) {
+	return conf.notificationHourStart, conf.notificationHourEnd
+}
+
+// DailyReportEnabled reports whether the admin gets the business summary of every day.
+func DailyReportEnabled() bool {
+	return conf.dailyReport
+}
+
+// WeeklyReportEnabled reports whether the admin gets the business summary of every week.
+func WeeklyReportEnabled() bool {
+	return conf.weeklyReport
+}
+
+// AlertChatID is the chat receiving the operational alerts, 0 if the alerts are disabled.
+func AlertChatID() int64 {
+	return conf.alertChatID
+}
+
+// AlertDigestInterval is how often alerts of the same type are sent, the ones in between are sent as a digest.
+func AlertDigestInterval() time.Duration {
+	return time.Duration(conf.alertDigestInterval) * time.Minute
+}
+
+func LinkResetCooldown() time.Duration {
+	return time.Duration(conf.linkResetCooldown) * time.Hour
+}
+
 func InboundUUIDs() map[string]string {
 	return conf.inboundUUIDs
 }
 
+func AllowedCountries() map[string]bool {
+	return conf.allowedCountries
+}
+
 func TrialTrafficLimit() int {
 	return conf.trialTrafficLimit * bytesInGigabyte
 }
 
+func TrafficLimitStrategy() string {
+	return conf.trafficLimitStrategy
+}
+
+func TrialTrafficLimitStrategy() string {
+	return conf.trialTrafficStrategy
+}
+
+func ResetTrafficOnRenewal() bool {
+	return conf.resetTrafficOnRenewal
+}
+
+func TrialRequireUsername() bool {
+	return conf.trialRequireUsername
+}
+
+func TrialMaxTelegramId() int64 {
+	return conf.trialMaxTelegramId
+}
+
 func TrialDays() int {
 	return conf.trialDays
 }
@@ -71,10 +201,26 @@ func ChannelURL() string {
 	return conf.channelURL
 }
 
+func ChannelID() string {
+	return conf.channelID
+}
+
+func IsChannelSubscriptionRequired() bool {
+	return conf.channelRequired
+}
+
+func IsChannelRecheckEnabled() bool {
+	return conf.channelRecheck
+}
+
 func ServerStatusURL() string {
 	return conf.serverStatusURL
 }
 
+func IsNodeAlertsEnabled() bool {
+	return conf.nodeAlertsEnabled
+}
+
 func SupportURL() string {
 	return conf.supportURL
 }
@@ -98,6 +244,22 @@ func Price6() int {
 func Price12() int {
 	return conf.price12
 }
+
+// Price returns the price of the tariff of the given months, or 0 if there is no such tariff.
+func Price(months int) int {
+	switch months {
+	case 1:
+		return Price1()
+	case 3:
+		return Price3()
+	case 6:
+		return Price6()
+	case 12:
+		return Price12()
+	default:
+		return 0
+	}
+}
 func TelegramToken() string {
 	return conf.telegramToken
 }
@@ -156,6 +318,13 @@ func GetAdminTelegramId() int64 {
 
 const bytesInGigabyte = 1073741824
 
+var trafficLimitStrategies = map[string]bool{
+	"NO_RESET": true,
+	"DAY":      true,
+	"WEEK":     true,
+	"MONTH":    true,
+}
+
 func InitConfig() {
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -187,6 +356,15 @@ func InitConfig() {
 		panic("TRIAL_DAYS .env variable not set")
 	}
 
+	conf.trialRequireUsername = os.Getenv("TRIAL_REQUIRE_USERNAME") == "true"
+
+	if maxId := os.Getenv("TRIAL_MAX_TELEGRAM_ID"); maxId != "" {
+		conf.trialMaxTelegramId, err = strconv.ParseInt(maxId, 10, 64)
+		if err != nil {
+			panic("TRIAL_MAX_TELEGRAM_ID .env variable must be a number")
+		}
+	}
+
 	strPrice := os.Getenv("PRICE_1")
 	if strPrice == "" {
 		panic("PRICE_1 .env variable not set")
@@ -227,22 +405,8 @@ func InitConfig() {
 	}
 	conf.price12 = price12
 
-	conf.remnawaveUrl = os.Getenv("REMNAWAVE_URL")
-	if conf.remnawaveUrl == "" {
-		panic("REMNAWAVE_URL .env variable not set")
-	}
-
-	conf.remnawaveMode = os.Getenv("REMNAWAVE_MODE")
-	if conf.remnawaveMode == "" {
-		conf.remnawaveMode = "remote"
-	} else if conf.remnawaveMode != "remote" && conf.remnawaveMode != "local" {
-		panic("REMNAWAVE_MODE .env variable must be either 'remote' or 'local'")
-	}
-
-	conf.remnawaveToken = os.Getenv("REMNAWAVE_TOKEN")
-	if conf.remnawaveToken == "" {
-		panic("REMNAWAVE_TOKEN .env variable not set")
-	}
+	initPanels()
+	initCampaigns()
 
 	conf.databaseURL = os.Getenv("DATABASE_URL")
 	if conf.databaseURL == "" {
@@ -289,17 +453,178 @@ func InitConfig() {
 	}
 	conf.trafficLimit = limit
 
+	conf.trafficLimitStrategy = strings.ToUpper(os.Getenv("TRAFFIC_LIMIT_STRATEGY"))
+	if conf.trafficLimitStrategy == "" {
+		conf.trafficLimitStrategy = "MONTH"
+	} else if !trafficLimitStrategies[conf.trafficLimitStrategy] {
+		panic("TRAFFIC_LIMIT_STRATEGY .env variable must be one of NO_RESET, DAY, WEEK, MONTH")
+	}
+
+	conf.trialTrafficStrategy = strings.ToUpper(os.Getenv("TRIAL_TRAFFIC_LIMIT_STRATEGY"))
+	if conf.trialTrafficStrategy == "" {
+		conf.trialTrafficStrategy = conf.trafficLimitStrategy
+	} else if !trafficLimitStrategies[conf.trialTrafficStrategy] {
+		panic("TRIAL_TRAFFIC_LIMIT_STRATEGY .env variable must be one of NO_RESET, DAY, WEEK, MONTH")
+	}
+
+	conf.resetTrafficOnRenewal = os.Getenv("RESET_TRAFFIC_ON_RENEWAL") != "false"
+
 	conf.referralDays, err = strconv.Atoi(os.Getenv("REFERRAL_DAYS"))
 	if err != nil {
 		panic("REFERRAL_DAYS .env variable not set")
 	}
 
 	conf.serverStatusURL = os.Getenv("SERVER_STATUS_URL")
+	conf.nodeAlertsEnabled = os.Getenv("NODE_ALERTS_ENABLED") == "true"
 	conf.supportURL = os.Getenv("SUPPORT_URL")
 	conf.feedbackURL = os.Getenv("FEEDBACK_URL")
 	conf.channelURL = os.Getenv("CHANNEL_URL")
 	conf.tosURL = os.Getenv("TOS_URL")
 
+	conf.channelRequired = os.Getenv("CHANNEL_SUBSCRIPTION_REQUIRED") == "true"
+	if conf.channelRequired {
+		conf.channelID = os.Getenv("CHANNEL_ID")
+		if conf.channelID == "" {
+			panic("CHANNEL_ID .env variable not set")
+		}
+		conf.channelRecheck = os.Getenv("CHANNEL_RECHECK_ENABLED") == "true"
+	}
+
+	conf.linkResetCooldown = 24
+	if cooldown := os.Getenv("LINK_RESET_COOLDOWN_HOURS"); cooldown != "" {
+		conf.linkResetCooldown, err = strconv.Atoi(cooldown)
+		if err != nil {
+			panic("LINK_RESET_COOLDOWN_HOURS .env variable must be a number")
+		}
+	}
+
+	conf.syncCron = os.Getenv("SYNC_CRON")
+
+	conf.notificationStages = []int{3, 1, 0}
+	if stages, ok := os.LookupEnv("NOTIFICATION_STAGES"); ok {
+		conf.notificationStages = nil
+		seen := make(map[int]bool)
+		for _, value := range strings.Split(stages, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			stage, err := strconv.Atoi(value)
+			if err != nil {
+				panic("NOTIFICATION_STAGES .env variable must be a comma-separated list of numbers")
+			}
+			if !seen[stage] {
+				seen[stage] = true
+				conf.notificationStages = append(conf.notificationStages, stage)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(conf.notificationStages)))
+	}
+
+	conf.trafficThresholds = []int{95, 80}
+	if thresholds, ok := os.LookupEnv("TRAFFIC_THRESHOLDS"); ok {
+		conf.trafficThresholds = nil
+		for _, value := range strings.Split(thresholds, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			threshold, err := strconv.Atoi(value)
+			if err != nil || threshold <= 0 || threshold > 100 {
+				panic("TRAFFIC_THRESHOLDS .env variable must be a comma-separated list of percents from 1 to 100")
+			}
+			conf.trafficThresholds = append(conf.trafficThresholds, threshold)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(conf.trafficThresholds)))
+	}
+
+	conf.defaultTimezone = os.Getenv("DEFAULT_TIMEZONE")
+	if conf.defaultTimezone == "" {
+		conf.defaultTimezone = "UTC"
+	} else if _, err := time.LoadLocation(conf.defaultTimezone); err != nil {
+		panic("DEFAULT_TIMEZONE .env variable must be an IANA timezone, e.g. Europe/Moscow")
+	}
+
+	conf.notificationHourStart, conf.notificationHourEnd = 10, 21
+	if hours := os.Getenv("NOTIFICATION_HOURS"); hours != "" {
+		start, end, found := strings.Cut(hours, "-")
+		conf.notificationHourStart, err = strconv.Atoi(strings.TrimSpace(start))
+		if err == nil && found {
+			conf.notificationHourEnd, err = strconv.Atoi(strings.TrimSpace(end))
+		}
+		if err != nil || !found || conf.notificationHourStart < 0 || conf.notificationHourEnd > 24 || conf.notificationHourStart >= conf.notificationHourEnd {
+			panic("NOTIFICATION_HOURS .env variable must be a range of hours, e.g. 10-21")
+		}
+	}
+
+	conf.remnawaveTimeout = 10
+	if timeout := os.Getenv("REMNAWAVE_TIMEOUT_SECONDS"); timeout != "" {
+		conf.remnawaveTimeout, err = strconv.Atoi(timeout)
+		if err != nil || conf.remnawaveTimeout <= 0 {
+			panic("REMNAWAVE_TIMEOUT_SECONDS .env variable must be a positive number")
+		}
+	}
+
+	if chatID := os.Getenv("ALERT_CHAT_ID"); chatID != "" {
+		conf.alertChatID, err = strconv.ParseInt(chatID, 10, 64)
+		if err != nil {
+			panic("ALERT_CHAT_ID .env variable must be a number")
+		}
+	}
+
+	conf.alertDigestInterval = 10
+	if interval := os.Getenv("ALERT_DIGEST_MINUTES"); interval != "" {
+		conf.alertDigestInterval, err = strconv.Atoi(interval)
+		if err != nil || conf.alertDigestInterval <= 0 {
+			panic("ALERT_DIGEST_MINUTES .env variable must be a positive number")
+		}
+	}
+
+	conf.dailyReport, conf.weeklyReport = true, true
+	if reports, ok := os.LookupEnv("ADMIN_REPORTS"); ok {
+		conf.dailyReport, conf.weeklyReport = false, false
+		for _, value := range strings.Split(reports, ",") {
+			switch strings.TrimSpace(value) {
+			case "daily":
+				conf.dailyReport = true
+			case "weekly":
+				conf.weeklyReport = true
+			case "":
+			default:
+				panic("ADMIN_REPORTS .env variable must be a comma-separated list of daily and weekly")
+			}
+		}
+	}
+
+	conf.remnawaveRetries = 2
+	if retries := os.Getenv("REMNAWAVE_RETRIES"); retries != "" {
+		conf.remnawaveRetries, err = strconv.Atoi(retries)
+		if err != nil || conf.remnawaveRetries < 0 {
+			panic("REMNAWAVE_RETRIES .env variable must be a non-negative number")
+		}
+	}
+
+	// the metrics are not authenticated, so by default they are only served to the host
+	conf.metricsAddr = "127.0.0.1:9090"
+	if addr, ok := os.LookupEnv("METRICS_ADDR"); ok {
+		conf.metricsAddr = addr
+	}
+
+	conf.isWebhookEnabled = os.Getenv("WEBHOOK_ENABLED") == "true"
+	if conf.isWebhookEnabled {
+		conf.webhookSecret = os.Getenv("WEBHOOK_SECRET")
+		if conf.webhookSecret == "" {
+			panic("WEBHOOK_SECRET .env variable not set")
+		}
+		conf.webhookPort = 8080
+		if port := os.Getenv("WEBHOOK_PORT"); port != "" {
+			conf.webhookPort, err = strconv.Atoi(port)
+			if err != nil {
+				panic("WEBHOOK_PORT .env variable must be a number")
+			}
+		}
+	}
+
 	inboundUUIDsStr := os.Getenv("INBOUND_UUIDS")
 	if inboundUUIDsStr != "" {
 		uuids := strings.Split(inboundUUIDsStr, ",")
@@ -313,4 +638,13 @@ func InitConfig() {
 		conf.inboundUUIDs = map[string]string{}
 		slog.Info("No inbound UUIDs specified, all will be used")
 	}
+
+	conf.allowedCountries = map[string]bool{}
+	allowedCountriesStr := os.Getenv("ALLOWED_COUNTRIES")
+	if allowedCountriesStr != "" {
+		for _, code := range strings.Split(allowedCountriesStr, ",") {
+			conf.allowedCountries[strings.ToUpper(strings.TrimSpace(code))] = true
+		}
+		slog.Info("Loaded allowed countries", "countries", allowedCountriesStr)
+	}
 }
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPanel = "default"
+
+	PlacementFillFirst  = "fill-first"
+	PlacementRoundRobin = "round-robin"
+	PlacementByTariff   = "by-tariff"
+)
+
+type PanelConfig struct {
+	Name  string
+	URL   string
+	Token string
+	Mode  string
+	// Capacity is the number of users after which fill-first placement moves on to the next panel, 0 means unlimited.
+	Capacity int
+	// Tariffs are the purchase months ("1", "3", "6", "12"), "trial" and "referral" placed on the panel by the by-tariff placement.
+	Tariffs map[string]bool
+}
+
+func Panels() []PanelConfig {
+	return conf.panels
+}
+
+func PanelPlacement() string {
+	return conf.panelPlacement
+}
+
+// initPanels reads the panels from REMNAWAVE_PANELS, each configured by REMNAWAVE_<NAME>_* variables.
+// Without REMNAWAVE_PANELS a single panel is configured by REMNAWAVE_URL, REMNAWAVE_TOKEN and REMNAWAVE_MODE.
+func initPanels() {
+	conf.panelPlacement = os.Getenv("PANEL_PLACEMENT")
+	if conf.panelPlacement == "" {
+		conf.panelPlacement = PlacementFillFirst
+	} else if conf.panelPlacement != PlacementFillFirst && conf.panelPlacement != PlacementRoundRobin && conf.panelPlacement != PlacementByTariff {
+		panic("PANEL_PLACEMENT .env variable must be one of fill-first, round-robin, by-tariff")
+	}
+
+	panelNames := os.Getenv("REMNAWAVE_PANELS")
+	if panelNames == "" {
+		conf.remnawaveUrl = os.Getenv("REMNAWAVE_URL")
+		if conf.remnawaveUrl == "" {
+			panic("REMNAWAVE_URL .env variable not set")
+		}
+
+		conf.remnawaveMode = os.Getenv("REMNAWAVE_MODE")
+		if conf.remnawaveMode == "" {
+			conf.remnawaveMode = "remote"
+		} else if conf.remnawaveMode != "remote" && conf.remnawaveMode != "local" {
+			panic("REMNAWAVE_MODE .env variable must be either 'remote' or 'local'")
+		}
+
+		conf.remnawaveToken = os.Getenv("REMNAWAVE_TOKEN")
+		if conf.remnawaveToken == "" {
+			panic("REMNAWAVE_TOKEN .env variable not set")
+		}
+
+		conf.panels = []PanelConfig{{Name: DefaultPanel, URL: conf.remnawaveUrl, Token: conf.remnawaveToken, Mode: conf.remnawaveMode}}
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(panelNames, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		conf.panels = append(conf.panels, readPanel(name))
+	}
+	if len(conf.panels) == 0 {
+		panic("REMNAWAVE_PANELS .env variable must contain at least one panel name")
+	}
+
+	conf.remnawaveUrl = conf.panels[0].URL
+	conf.remnawaveToken = conf.panels[0].Token
+	conf.remnawaveMode = conf.panels[0].Mode
+}
+
+func readPanel(name string) PanelConfig {
+	prefix := "REMNAWAVE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	panel := PanelConfig{Name: name, Tariffs: make(map[string]bool)}
+
+	panel.URL = os.Getenv(prefix + "URL")
+	if panel.URL == "" {
+		panic(fmt.Sprintf("%sURL .env variable not set", prefix))
+	}
+
+	panel.Token = os.Getenv(prefix + "TOKEN")
+	if panel.Token == "" {
+		panic(fmt.Sprintf("%sTOKEN .env variable not set", prefix))
+	}
+
+	panel.Mode = os.Getenv(prefix + "MODE")
+	if panel.Mode == "" {
+		panel.Mode = "remote"
+	} else if panel.Mode != "remote" && panel.Mode != "local" {
+		panic(fmt.Sprintf("%sMODE .env variable must be either 'remote' or 'local'", prefix))
+	}
+
+	if capacity := os.Getenv(prefix + "CAPACITY"); capacity != "" {
+		var err error
+		panel.Capacity, err = strconv.Atoi(capacity)
+		if err != nil {
+			panic(fmt.Sprintf("%sCAPACITY .env variable must be a number", prefix))
+		}
+	}
+
+	for _, tariff := range strings.Split(os.Getenv(prefix+"TARIFFS"), ",") {
+		if tariff = strings.ToLower(strings.TrimSpace(tariff)); tariff != "" {
+			panel.Tariffs[tariff] = true
+		}
+	}
+
+	return panel
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// CampaignDelivery is a win-back message sent to a customer. Period is the expiration date the campaign
+// reacted to, so a campaign reaches the customer once per lapsed subscription.
+type CampaignDelivery struct {
+	ID              int64      `db:"id"`
+	Campaign        string     `db:"campaign"`
+	CustomerID      int64      `db:"customer_id"`
+	Period          time.Time  `db:"period"`
+	DiscountPercent int        `db:"discount_percent"`
+	DiscountUntil   *time.Time `db:"discount_until"`
+	SentAt          time.Time  `db:"sent_at"`
+	ConvertedAt     *time.Time `db:"converted_at"`
+	PurchaseID      *int64     `db:"purchase_id"`
+}
+
+// Apply returns the price with the discount of the delivery, at least 1.
+func (d *CampaignDelivery) Apply(price int) int {
+	return max(price*(100-d.DiscountPercent)/100, 1)
+}
+
+type CampaignStats struct {
+	Campaign  string
+	Sent      int
+	Converted int
+}
+
+type CampaignRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewCampaignRepository(pool *pgxpool.Pool) *CampaignRepository {
+	return &CampaignRepository{pool: pool}
+}
+
+// Claim records the delivery and reports whether the campaign didn't reach the customer in this period yet.
+func (r *CampaignRepository) Claim(ctx context.Context, delivery *CampaignDelivery) (bool, error) {
+	buildInsert := sq.Insert("campaign_delivery").
+		Columns("campaign", "customer_id", "period", "discount_percent", "discount_until").
+		Values(delivery.Campaign, delivery.CustomerID, delivery.Period, delivery.DiscountPercent, delivery.DiscountUntil).
+		Suffix("ON CONFLICT (campaign, customer_id, period) DO NOTHING RETURNING id, sent_at").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildInsert.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build insert campaign delivery query: %w", err)
+	}
+
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&delivery.ID, &delivery.SentAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to insert campaign delivery: %w", err)
+	}
+	return true, nil
+}
+
+// Release removes a delivery that could not be sent, so it is retried on the next run.
+func (r *CampaignRepository) Release(ctx context.Context, id int64) error {
+	buildDelete := sq.Delete("campaign_delivery").
+		Where(sq.Eq{"id": id}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildDelete.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build delete campaign delivery query: %w", err)
+	}
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to delete campaign delivery: %w", err)
+	}
+	return nil
+}
+
+// FindActiveDiscount returns the largest personal discount of the customer that is still valid and unused, or nil.
+func (r *CampaignRepository) FindActiveDiscount(ctx context.Context, customerID int64) (*CampaignDelivery, error) {
+	buildSelect := sq.Select("id", "campaign", "customer_id", "period", "discount_percent", "discount_until", "sent_at", "converted_at", "purchase_id").
+		From("campaign_delivery").
+		Where(sq.And{
+			sq.Eq{"customer_id": customerID, "converted_at": nil},
+			sq.Gt{"discount_percent": 0},
+			sq.Gt{"discount_until": time.Now()},
+		}).
+		OrderBy("discount_percent DESC").
+		Limit(1).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select campaign discount query: %w", err)
+	}
+
+	var delivery CampaignDelivery
+	err = r.pool.QueryRow(ctx, sql, args...).Scan(&delivery.ID, &delivery.Campaign, &delivery.CustomerID, &delivery.Period,
+		&delivery.DiscountPercent, &delivery.DiscountUntil, &delivery.SentAt, &delivery.ConvertedAt, &delivery.PurchaseID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query campaign discount: %w", err)
+	}
+	return &delivery, nil
+}
+
+// MarkConverted attributes the paid purchase to a campaign delivery. A purchase created with a discount converts
+// exactly that delivery, which uses the discount up. Otherwise it is attributed to the latest delivery of the customer
+// sent after since whose discount can't be used anymore, so an unused discount is kept for a later purchase.
+func (r *CampaignRepository) MarkConverted(ctx context.Context, purchase *Purchase, since time.Time) error {
+	delivery := sq.Expr("id = ?", purchase.CampaignDeliveryID)
+	if purchase.CampaignDeliveryID == nil {
+		now := time.Now()
+		delivery = sq.Expr("id = (?)", sq.Select("id").
+			From("campaign_delivery").
+			Where(sq.And{
+				sq.Eq{"customer_id": purchase.CustomerID, "converted_at": nil},
+				sq.GtOrEq{"sent_at": since},
+				sq.Or{sq.Eq{"discount_percent": 0}, sq.LtOrEq{"discount_until": now}},
+			}).
+			OrderBy("sent_at DESC").
+			Limit(1))
+	}
+
+	buildUpdate := sq.Update("campaign_delivery").
+		Set("converted_at", time.Now()).
+		Set("purchase_id", purchase.ID).
+		Where(sq.And{delivery, sq.Eq{"converted_at": nil}}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update campaign delivery query: %w", err)
+	}
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to mark campaign delivery converted: %w", err)
+	}
+	return nil
+}
+
+// Stats returns the number of sent and converted deliveries of every campaign.
+func (r *CampaignRepository) Stats(ctx context.Context) ([]CampaignStats, error) {
+	buildSelect := sq.Select("campaign", "COUNT(*)", "COUNT(converted_at)").
+		From("campaign_delivery").
+		GroupBy("campaign").
+		OrderBy("campaign").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select campaign stats query: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query campaign stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []CampaignStats
+	for rows.Next() {
+		var s CampaignStats
+		if err := rows.Scan(&s.Campaign, &s.Sent, &s.Converted); err != nil {
+			return nil, fmt.Errorf("failed to scan campaign stats row: %w", err)
+		}
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over campaign stats rows: %w", err)
+	}
+	return stats, nil
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"remnawave-tg-shop-bot/internal/timezone"
+	"strings"
 	"time"
 )
 
@@ -25,14 +28,85 @@ type Customer struct {
 	CreatedAt        time.Time  `db:"created_at"`
 	SubscriptionLink *string    `db:"subscription_link"`
 	Language         string     `db:"language"`
+	TrialUsedAt      *time.Time `db:"trial_used_at"`
+	LinkResetAt      *time.Time `db:"link_reset_at"`
+	ArchivedAt       *time.Time `db:"archived_at"`
+	PanelID          *string    `db:"panel_id"`
+	RemnawaveUUID    *uuid.UUID `db:"remnawave_uuid"`
+	Username         *string    `db:"username"`
+	FirstName        *string    `db:"first_name"`
+	LastName         *string    `db:"last_name"`
+	IsPremium        bool       `db:"is_premium"`
+	Timezone         *string    `db:"timezone"`
+}
+
+var customerColumns = []string{"id", "telegram_id", "expire_at", "created_at", "subscription_link", "language", "trial_used_at", "link_reset_at", "archived_at", "panel_id", "remnawave_uuid",
+	"username", "first_name", "last_name", "is_premium", "timezone"}
+
+// Location returns the timezone of the customer to show dates and deliver notifications in: the one chosen
+// in the settings, or the one inferred from the language if the customer didn't choose.
+func (c *Customer) Location() *time.Location {
+	if c.Timezone != nil {
+		return timezone.Load(*c.Timezone)
+	}
+	return timezone.Load(timezone.FromLanguage(c.Language))
+}
+
+// Profile describes the customer by the telegram profile, e.g. "@john · John Smith · premium".
+// It is used as the panel user description and in the admin messages.
+func (c *Customer) Profile() string {
+	var parts []string
+	if c.Username != nil && *c.Username != "" {
+		parts = append(parts, "@"+*c.Username)
+	}
+	var name []string
+	if c.FirstName != nil && *c.FirstName != "" {
+		name = append(name, *c.FirstName)
+	}
+	if c.LastName != nil && *c.LastName != "" {
+		name = append(name, *c.LastName)
+	}
+	if len(name) > 0 {
+		parts = append(parts, strings.Join(name, " "))
+	}
+	if c.IsPremium {
+		parts = append(parts, "premium")
+	}
+	return strings.Join(parts, " · ")
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCustomer(row rowScanner, customer *Customer) error {
+	return row.Scan(
+		&customer.ID,
+		&customer.TelegramID,
+		&customer.ExpireAt,
+		&customer.CreatedAt,
+		&customer.SubscriptionLink,
+		&customer.Language,
+		&customer.TrialUsedAt,
+		&customer.LinkResetAt,
+		&customer.ArchivedAt,
+		&customer.PanelID,
+		&customer.RemnawaveUUID,
+		&customer.Username,
+		&customer.FirstName,
+		&customer.LastName,
+		&customer.IsPremium,
+		&customer.Timezone,
+	)
 }
 
 func (cr *CustomerRepository) FindByExpirationRange(ctx context.Context, startDate, endDate time.Time) (*[]Customer, error) {
-	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+	buildSelect := sq.Select(customerColumns...).
 		From("customer").
 		Where(
 			sq.And{
 				sq.NotEq{"expire_at": nil},
+				sq.Eq{"archived_at": nil},
 				sq.GtOrEq{"expire_at": startDate},
 				sq.LtOrEq{"expire_at": endDate},
 			},
@@ -53,14 +127,7 @@ func (cr *CustomerRepository) FindByExpirationRange(ctx context.Context, startDa
 	var customers []Customer
 	for rows.Next() {
 		var customer Customer
-		err := rows.Scan(
-			&customer.ID,
-			&customer.TelegramID,
-			&customer.ExpireAt,
-			&customer.CreatedAt,
-			&customer.SubscriptionLink,
-			&customer.Language,
-		)
+		err := scanCustomer(rows, &customer)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan customer row: %w", err)
 		}
@@ -74,8 +141,129 @@ func (cr *CustomerRepository) FindByExpirationRange(ctx context.Context, startDa
 	return &customers, nil
 }
 
+func (cr *CustomerRepository) FindActiveTrialCustomers(ctx context.Context) ([]Customer, error) {
+	buildSelect := sq.Select(customerColumns...).
+		From("customer").
+		Where(
+			sq.And{
+				sq.NotEq{"trial_used_at": nil},
+				sq.Eq{"archived_at": nil},
+				sq.Gt{"expire_at": time.Now()},
+				sq.Expr("NOT EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", PurchaseStatusPaid),
+			},
+		).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active trial customers: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		if err := scanCustomer(rows, &customer); err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
+	}
+
+	return customers, nil
+}
+
+// FindExpiredBetween returns the not archived customers whose subscription expired in [from, to).
+// With neverPaid only the customers who used the trial and have no paid purchase are returned.
+func (cr *CustomerRepository) FindExpiredBetween(ctx context.Context, from, to time.Time, neverPaid bool) ([]Customer, error) {
+	conditions := sq.And{
+		sq.Eq{"archived_at": nil},
+		sq.GtOrEq{"expire_at": from},
+		sq.Lt{"expire_at": to},
+		sq.Lt{"expire_at": time.Now()},
+	}
+	if neverPaid {
+		conditions = append(conditions,
+			sq.NotEq{"trial_used_at": nil},
+			sq.Expr("NOT EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", PurchaseStatusPaid))
+	}
+
+	buildSelect := sq.Select(customerColumns...).
+		From("customer").
+		Where(conditions).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired customers: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		if err := scanCustomer(rows, &customer); err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
+	}
+
+	return customers, nil
+}
+
+// FindWithActiveSubscription returns the customers, including archived ones, whose subscription has not expired yet.
+func (cr *CustomerRepository) FindWithActiveSubscription(ctx context.Context) ([]Customer, error) {
+	buildSelect := sq.Select(customerColumns...).
+		From("customer").
+		Where(sq.Gt{"expire_at": time.Now()}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customers with active subscription: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		if err := scanCustomer(rows, &customer); err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
+	}
+
+	return customers, nil
+}
+
 func (cr *CustomerRepository) FindById(ctx context.Context, id int64) (*Customer, error) {
-	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+	buildSelect := sq.Select(customerColumns...).
 		From("customer").
 		Where(sq.Eq{"id": id}).
 		PlaceholderFormat(sq.Dollar)
@@ -87,14 +275,7 @@ func (cr *CustomerRepository) FindById(ctx context.Context, id int64) (*Customer
 
 	var customer Customer
 
-	err = cr.pool.QueryRow(ctx, sql, args...).Scan(
-		&customer.ID,
-		&customer.TelegramID,
-		&customer.ExpireAt,
-		&customer.CreatedAt,
-		&customer.SubscriptionLink,
-		&customer.Language,
-	)
+	err = scanCustomer(cr.pool.QueryRow(ctx, sql, args...), &customer)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -105,7 +286,7 @@ func (cr *CustomerRepository) FindById(ctx context.Context, id int64) (*Customer
 }
 
 func (cr *CustomerRepository) FindByTelegramId(ctx context.Context, telegramId int64) (*Customer, error) {
-	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+	buildSelect := sq.Select(customerColumns...).
 		From("customer").
 		Where(sq.Eq{"telegram_id": telegramId}).
 		PlaceholderFormat(sq.Dollar)
@@ -117,14 +298,7 @@ func (cr *CustomerRepository) FindByTelegramId(ctx context.Context, telegramId i
 
 	var customer Customer
 
-	err = cr.pool.QueryRow(ctx, sql, args...).Scan(
-		&customer.ID,
-		&customer.TelegramID,
-		&customer.ExpireAt,
-		&customer.CreatedAt,
-		&customer.SubscriptionLink,
-		&customer.Language,
-	)
+	err = scanCustomer(cr.pool.QueryRow(ctx, sql, args...), &customer)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -136,9 +310,9 @@ func (cr *CustomerRepository) FindByTelegramId(ctx context.Context, telegramId i
 
 func (cr *CustomerRepository) Create(ctx context.Context, customer *Customer) (*Customer, error) {
 	buildInsert := sq.Insert("customer").
-		Columns("telegram_id", "expire_at", "language").
+		Columns("telegram_id", "expire_at", "language", "username", "first_name", "last_name", "is_premium").
 		PlaceholderFormat(sq.Dollar).
-		Values(customer.TelegramID, customer.ExpireAt, customer.Language).
+		Values(customer.TelegramID, customer.ExpireAt, customer.Language, customer.Username, customer.FirstName, customer.LastName, customer.IsPremium).
 		Suffix("RETURNING id, created_at")
 	sqlStr, args, err := buildInsert.ToSql()
 	if err != nil {
@@ -200,7 +374,7 @@ func (cr *CustomerRepository) UpdateFields(ctx context.Context, id int64, update
 }
 
 func (cr *CustomerRepository) FindByTelegramIds(ctx context.Context, telegramIDs []int64) ([]Customer, error) {
-	buildSelect := sq.Select("id", "telegram_id", "expire_at", "created_at", "subscription_link", "language").
+	buildSelect := sq.Select(customerColumns...).
 		From("customer").
 		Where(sq.Eq{"telegram_id": telegramIDs}).
 		PlaceholderFormat(sq.Dollar)
@@ -219,14 +393,7 @@ func (cr *CustomerRepository) FindByTelegramIds(ctx context.Context, telegramIDs
 	var customers []Customer
 	for rows.Next() {
 		var customer Customer
-		err := rows.Scan(
-			&customer.ID,
-			&customer.TelegramID,
-			&customer.ExpireAt,
-			&customer.CreatedAt,
-			&customer.SubscriptionLink,
-			&customer.Language,
-		)
+		err := scanCustomer(rows, &customer)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan customer row: %w", err)
 		}
@@ -244,10 +411,14 @@ func (cr *CustomerRepository) CreateBatch(ctx context.Context, customers []Custo
 		return nil
 	}
 	builder := sq.Insert("customer").
-		Columns("telegram_id", "expire_at", "language", "subscription_link").
+		Columns("telegram_id", "expire_at", "language", "subscription_link", "created_at", "panel_id", "remnawave_uuid").
 		PlaceholderFormat(sq.Dollar)
 	for _, cust := range customers {
-		builder = builder.Values(cust.TelegramID, cust.ExpireAt, cust.Language, cust.SubscriptionLink)
+		createdAt := cust.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		builder = builder.Values(cust.TelegramID, cust.ExpireAt, cust.Language, cust.SubscriptionLink, createdAt, cust.PanelID, cust.RemnawaveUUID)
 	}
 	sqlStr, args, err := builder.ToSql()
 	if err != nil {
@@ -277,16 +448,16 @@ func (cr *CustomerRepository) UpdateBatch(ctx context.Context, customers []Custo
 	if len(customers) == 0 {
 		return nil
 	}
-	query := "UPDATE customer SET expire_at = c.expire_at, language = c.language, subscription_link = c.subscription_link FROM (VALUES "
+	query := "UPDATE customer SET expire_at = c.expire_at, subscription_link = c.subscription_link, panel_id = c.panel_id, remnawave_uuid = c.remnawave_uuid, archived_at = NULL FROM (VALUES "
 	var args []interface{}
 	for i, cust := range customers {
 		if i > 0 {
 			query += ", "
 		}
-		query += fmt.Sprintf("($%d::bigint, $%d::timestamp, $%d::text, $%d::text)", i*4+1, i*4+2, i*4+3, i*4+4)
-		args = append(args, cust.TelegramID, cust.ExpireAt, cust.Language, cust.SubscriptionLink)
+		query += fmt.Sprintf("($%d::bigint, $%d::timestamp, $%d::text, $%d::text, $%d::uuid)", i*5+1, i*5+2, i*5+3, i*5+4, i*5+5)
+		args = append(args, cust.TelegramID, cust.ExpireAt, cust.SubscriptionLink, cust.PanelID, cust.RemnawaveUUID)
 	}
-	query += ") AS c(telegram_id, expire_at, language, subscription_link) WHERE customer.telegram_id = c.telegram_id"
+	query += ") AS c(telegram_id, expire_at, subscription_link, panel_id, remnawave_uuid) WHERE customer.telegram_id = c.telegram_id"
 
 	tx, err := cr.pool.Begin(ctx)
 	if err != nil {
@@ -306,28 +477,90 @@ func (cr *CustomerRepository) UpdateBatch(ctx context.Context, customers []Custo
 	return nil
 }
 
-func (cr *CustomerRepository) DeleteByNotInTelegramIds(ctx context.Context, telegramIDs []int64) error {
-	var buildDelete sq.DeleteBuilder
+// FindNotArchivedExcept returns the customers that are not archived and whose telegram id is not in telegramIDs.
+func (cr *CustomerRepository) FindNotArchivedExcept(ctx context.Context, telegramIDs []int64) ([]Customer, error) {
+	buildSelect := sq.Select(customerColumns...).
+		From("customer").
+		Where(sq.Eq{"archived_at": nil}).
+		PlaceholderFormat(sq.Dollar)
+	if len(telegramIDs) > 0 {
+		buildSelect = buildSelect.Where(sq.NotEq{"telegram_id": telegramIDs})
+	}
+
+	sqlStr, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	rows, err := cr.pool.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query customers: %w", err)
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var customer Customer
+		if err := scanCustomer(rows, &customer); err != nil {
+			return nil, fmt.Errorf("failed to scan customer row: %w", err)
+		}
+		customers = append(customers, customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over customer rows: %w", err)
+	}
+
+	return customers, nil
+}
+
+// ArchiveByTelegramIds marks the customers as archived instead of deleting them,
+// so their purchases and referrals are kept.
+func (cr *CustomerRepository) ArchiveByTelegramIds(ctx context.Context, telegramIDs []int64) error {
 	if len(telegramIDs) == 0 {
-		buildDelete = sq.Delete("customer")
-	} else {
-		buildDelete = sq.Delete("customer").
-			PlaceholderFormat(sq.Dollar).
-			Where(sq.NotEq{"telegram_id": telegramIDs})
+		return nil
 	}
 
-	sqlStr, args, err := buildDelete.ToSql()
+	buildUpdate := sq.Update("customer").
+		Set("archived_at", time.Now()).
+		Where(sq.Eq{"telegram_id": telegramIDs}).
+		PlaceholderFormat(sq.Dollar)
+
+	sqlStr, args, err := buildUpdate.ToSql()
 	if err != nil {
-		return fmt.Errorf("failed to build delete query: %w", err)
+		return fmt.Errorf("failed to build archive query: %w", err)
 	}
 
 	_, err = cr.pool.Exec(ctx, sqlStr, args...)
 	if err != nil {
-		return fmt.Errorf("failed to delete customers: %w", err)
+		return fmt.Errorf("failed to archive customers: %w", err)
 	}
 
 	return nil
+}
+
+// ClaimLinkReset sets link_reset_at to now unless the link was already reset within the cooldown,
+// and reports whether the reset was claimed, so concurrent resets can't both pass the check.
+func (cr *CustomerRepository) ClaimLinkReset(ctx context.Context, id int64, cooldown time.Duration) (bool, error) {
+	buildUpdate := sq.Update("customer").
+		Set("link_reset_at", sq.Expr("now()")).
+		Where(sq.Eq{"id": id}).
+		Where(sq.Or{
+			sq.Eq{"link_reset_at": nil},
+			sq.Expr("link_reset_at < now() - make_interval(secs => ?)", cooldown.Seconds()),
+		}).
+		PlaceholderFormat(sq.Dollar)
+
+	sqlStr, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build claim link reset query: %w", err)
+	}
+
+	result, err := cr.pool.Exec(ctx, sqlStr, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim link reset: %w", err)
+	}
 
+	return result.RowsAffected() > 0, nil
 }
 
 // GetPool возвращает пул соединений с базой данных
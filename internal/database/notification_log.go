@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// NotificationLogRepository records the notifications sent to customers. Each notification type is sent at most
+// once per period, identified by a timestamp: the expiration date for the subscription reminders, so they start
+// over after a renewal, or the last traffic reset for the traffic warnings.
+type NotificationLogRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewNotificationLogRepository(pool *pgxpool.Pool) *NotificationLogRepository {
+	return &NotificationLogRepository{pool: pool}
+}
+
+// Claim records the notification and reports whether it was not recorded before, i.e. whether it should be sent.
+func (r *NotificationLogRepository) Claim(ctx context.Context, customerID int64, notificationType string, period time.Time) (bool, error) {
+	buildInsert := sq.Insert("notification_log").
+		Columns("customer_id", "type", "period").
+		Values(customerID, notificationType, period).
+		Suffix("ON CONFLICT (customer_id, type, period) DO NOTHING RETURNING id").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildInsert.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build insert notification log query: %w", err)
+	}
+
+	var id int64
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to insert notification log: %w", err)
+	}
+	return true, nil
+}
+
+// Release removes the record of a notification that could not be delivered, so it is retried on the next run.
+func (r *NotificationLogRepository) Release(ctx context.Context, customerID int64, notificationType string, period time.Time) error {
+	buildDelete := sq.Delete("notification_log").
+		Where(sq.Eq{"customer_id": customerID, "type": notificationType, "period": period}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildDelete.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build delete notification log query: %w", err)
+	}
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to delete notification log: %w", err)
+	}
+	return nil
+}
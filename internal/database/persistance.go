@@ -13,6 +13,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"remnawave-tg-shop-bot/internal/alert"
 	"remnawave-tg-shop-bot/internal/config"
 )
 
@@ -61,6 +62,7 @@ func RunMigrations(ctx context.Context, migrationConfig *MigrationConfig, pool *
 
 	if dirty && version == 3 {
 		slog.Warn("Detected dirty migration at version 3: forcing pointer and running down script")
+		alert.Send(alert.Migration, "Dirty migration at version 3 detected, re-applying it")
 
 		// Снимаем dirty, устанавливая pointer на ту же версию без исполнения SQL
 		if err := m.Force(int(version)); err != nil {
@@ -26,23 +26,29 @@ const (
 	PurchaseStatusPending PurchaseStatus = "pending"
 	PurchaseStatusPaid    PurchaseStatus = "paid"
 	PurchaseStatusCancel  PurchaseStatus = "cancel"
+	// PurchaseStatusReceived is a Telegram Stars payment that was received but not provisioned yet, it is retried.
+	PurchaseStatusReceived PurchaseStatus = "received"
+	// PurchaseStatusProcessing is a purchase that is being provisioned. A purchase that failed after the panel
+	// was updated stays in it, so it is never extended twice.
+	PurchaseStatusProcessing PurchaseStatus = "processing"
 )
 
 type Purchase struct {
-	ID                int64          `db:"id"`
-	Amount            float64        `db:"amount"`
-	CustomerID        int64          `db:"customer_id"`
-	CreatedAt         time.Time      `db:"created_at"`
-	Month             int            `db:"month"`
-	PaidAt            *time.Time     `db:"paid_at"`
-	Currency          string         `db:"currency"`
-	ExpireAt          *time.Time     `db:"expire_at"`
-	Status            PurchaseStatus `db:"status"`
-	InvoiceType       InvoiceType    `db:"invoice_type"`
-	CryptoInvoiceID   *int64         `db:"crypto_invoice_id"`
-	CryptoInvoiceLink *string        `db:"crypto_invoice_url"`
-	YookasaURL        *string        `db:"yookasa_url"`
-	YookasaID         *uuid.UUID     `db:"yookasa_id"`
+	ID                 int64          `db:"id"`
+	Amount             float64        `db:"amount"`
+	CustomerID         int64          `db:"customer_id"`
+	CreatedAt          time.Time      `db:"created_at"`
+	Month              int            `db:"month"`
+	PaidAt             *time.Time     `db:"paid_at"`
+	Currency           string         `db:"currency"`
+	ExpireAt           *time.Time     `db:"expire_at"`
+	Status             PurchaseStatus `db:"status"`
+	InvoiceType        InvoiceType    `db:"invoice_type"`
+	CryptoInvoiceID    *int64         `db:"crypto_invoice_id"`
+	CryptoInvoiceLink  *string        `db:"crypto_invoice_url"`
+	YookasaURL         *string        `db:"yookasa_url"`
+	YookasaID          *uuid.UUID     `db:"yookasa_id"`
+	CampaignDeliveryID *int64         `db:"campaign_delivery_id"`
 }
 
 type PurchaseRepository struct {
@@ -57,8 +63,8 @@ func NewPurchaseRepository(pool *pgxpool.Pool) *PurchaseRepository {
 
 func (cr *PurchaseRepository) Create(ctx context.Context, purchase *Purchase) (int64, error) {
 	buildInsert := sq.Insert("purchase").
-		Columns("amount", "customer_id", "month", "currency", "expire_at", "status", "invoice_type", "crypto_invoice_id", "crypto_invoice_url", "yookasa_url", "yookasa_id").
-		Values(purchase.Amount, purchase.CustomerID, purchase.Month, purchase.Currency, purchase.ExpireAt, purchase.Status, purchase.InvoiceType, purchase.CryptoInvoiceID, purchase.CryptoInvoiceLink, purchase.YookasaURL, purchase.YookasaID).
+		Columns("amount", "customer_id", "month", "currency", "expire_at", "status", "invoice_type", "crypto_invoice_id", "crypto_invoice_url", "yookasa_url", "yookasa_id", "campaign_delivery_id").
+		Values(purchase.Amount, purchase.CustomerID, purchase.Month, purchase.Currency, purchase.ExpireAt, purchase.Status, purchase.InvoiceType, purchase.CryptoInvoiceID, purchase.CryptoInvoiceLink, purchase.YookasaURL, purchase.YookasaID, purchase.CampaignDeliveryID).
 		Suffix("RETURNING id").
 		PlaceholderFormat(sq.Dollar)
 
@@ -114,6 +120,7 @@ func (cr *PurchaseRepository) FindByInvoiceTypeAndStatus(ctx context.Context, in
 			&purchase.CryptoInvoiceLink,
 			&purchase.YookasaURL,
 			&purchase.YookasaID,
+			&purchase.CampaignDeliveryID,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan purchase: %w", err)
@@ -155,6 +162,7 @@ func (cr *PurchaseRepository) FindById(ctx context.Context, id int64) (*Purchase
 		&purchase.CryptoInvoiceLink,
 		&purchase.YookasaURL,
 		&purchase.YookasaID,
+		&purchase.CampaignDeliveryID,
 	)
 
 	if err != nil {
@@ -198,6 +206,24 @@ func (p *PurchaseRepository) UpdateFields(ctx context.Context, id int64, updates
 	return nil
 }
 
+func (pr *PurchaseRepository) HasPaid(ctx context.Context, customerID int64) (bool, error) {
+	buildSelect := sq.Select("COUNT(*)").
+		From("purchase").
+		Where(sq.Eq{"customer_id": customerID, "status": PurchaseStatusPaid}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build select query: %w", err)
+	}
+
+	var count int
+	if err := pr.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to count paid purchases: %w", err)
+	}
+	return count > 0, nil
+}
+
 func (pr *PurchaseRepository) MarkAsPaid(ctx context.Context, purchaseID int64) error {
 	currentTime := time.Now()
 
@@ -208,3 +234,60 @@ func (pr *PurchaseRepository) MarkAsPaid(ctx context.Context, purchaseID int64)
 
 	return pr.UpdateFields(ctx, purchaseID, updates)
 }
+
+// ClaimForProcessing moves a pending or received purchase to processing and reports whether it was claimed,
+// so a purchase can only be provisioned by one caller at a time.
+func (pr *PurchaseRepository) ClaimForProcessing(ctx context.Context, purchaseID int64) (bool, error) {
+	buildUpdate := sq.Update("purchase").
+		Set("status", PurchaseStatusProcessing).
+		Where(sq.Eq{"id": purchaseID, "status": []PurchaseStatus{PurchaseStatusPending, PurchaseStatusReceived}}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build update query: %w", err)
+	}
+
+	result, err := pr.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim purchase: %w", err)
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// ReleaseProcessing returns a claimed purchase that could not be provisioned to its previous status.
+func (pr *PurchaseRepository) ReleaseProcessing(ctx context.Context, purchaseID int64, status PurchaseStatus) error {
+	buildUpdate := sq.Update("purchase").
+		Set("status", status).
+		Where(sq.Eq{"id": purchaseID, "status": PurchaseStatusProcessing}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update query: %w", err)
+	}
+
+	if _, err := pr.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to release purchase: %w", err)
+	}
+	return nil
+}
+
+// MarkAsReceived keeps a pending purchase whose payment was received but not provisioned for a retry.
+// A purchase that was already marked as paid is left as is, so it is never provisioned twice.
+func (pr *PurchaseRepository) MarkAsReceived(ctx context.Context, purchaseID int64) error {
+	buildUpdate := sq.Update("purchase").
+		Set("status", PurchaseStatusReceived).
+		Where(sq.Eq{"id": purchaseID, "status": PurchaseStatusPending}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildUpdate.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update query: %w", err)
+	}
+
+	if _, err := pr.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to mark purchase received: %w", err)
+	}
+	return nil
+}
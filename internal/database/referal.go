@@ -119,23 +119,76 @@ func (r *ReferralRepository) FindByReferee(ctx context.Context, refereeID int64)
 	return &ref, nil
 }
 
-func (r *ReferralRepository) MarkBonusGranted(ctx context.Context, referralID int64) error {
+func (r *ReferralRepository) FindPendingBonusesByReferrer(ctx context.Context, referrerID int64) ([]Referral, error) {
+	query := sq.Select("r.id", "r.referrer_id", "r.referee_id", "r.used_at", "r.bonus_granted").
+		From("referral r").
+		Join("customer c ON c.telegram_id = r.referee_id").
+		Where(sq.And{
+			sq.Eq{"r.referrer_id": referrerID},
+			sq.Eq{"r.bonus_granted": false},
+			sq.Expr("EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = c.id AND p.status = ?)", PurchaseStatusPaid),
+		}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select pending referral bonuses query: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending referral bonuses: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Referral
+	for rows.Next() {
+		var ref Referral
+		if err := rows.Scan(&ref.ID, &ref.ReferrerID, &ref.RefereeID, &ref.UsedAt, &ref.BonusGranted); err != nil {
+			return nil, fmt.Errorf("failed to scan referral row: %w", err)
+		}
+		list = append(list, ref)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error iterating referral rows: %w", rows.Err())
+	}
+	return list, nil
+}
+
+// ClaimBonus marks the bonus as granted unless it already was and reports whether it was claimed,
+// so concurrent claims can't grant the same bonus twice.
+func (r *ReferralRepository) ClaimBonus(ctx context.Context, referralID int64) (bool, error) {
 	query := sq.Update("referral").
 		Set("bonus_granted", true).
-		Where(sq.Eq{"id": referralID}).
+		Where(sq.Eq{"id": referralID, "bonus_granted": false}).
 		PlaceholderFormat(sq.Dollar)
 
 	sql, args, err := query.ToSql()
 	if err != nil {
-		return fmt.Errorf("failed to build update bonus_granted query: %w", err)
+		return false, fmt.Errorf("failed to build update bonus_granted query: %w", err)
 	}
 
 	res, err := r.pool.Exec(ctx, sql, args...)
 	if err != nil {
-		return fmt.Errorf("failed to execute update bonus_granted: %w", err)
+		return false, fmt.Errorf("failed to execute update bonus_granted: %w", err)
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ReleaseBonus returns a claimed bonus that could not be granted, so it is granted on the next claim.
+func (r *ReferralRepository) ReleaseBonus(ctx context.Context, referralID int64) error {
+	query := sq.Update("referral").
+		Set("bonus_granted", false).
+		Where(sq.Eq{"id": referralID}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build update bonus_granted query: %w", err)
 	}
-	if res.RowsAffected() == 0 {
-		return errors.New("no referral record updated")
+
+	if _, err := r.pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("failed to execute update bonus_granted: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// Report sums up the business of the period [From, To).
+type Report struct {
+	From time.Time
+	To   time.Time
+
+	NewUsers  int
+	Referrals int
+
+	TrialsStarted int
+	// TrialsEnded are the trials that ended within the period, TrialsConverted the ones of them that were paid for since.
+	TrialsEnded     int
+	TrialsConverted int
+
+	FirstPurchases int
+	Renewals       int
+	Revenue        []Revenue
+
+	ActiveSubscriptions int
+	ActivePaid          int
+	// Churned are the paying customers whose subscription expired within the period without a renewal,
+	// ExpiredTrials the customers who never paid.
+	Churned       int
+	ExpiredTrials int
+}
+
+// Revenue is the sum of the paid purchases of a provider in a currency.
+type Revenue struct {
+	InvoiceType InvoiceType
+	Currency    string
+	Purchases   int
+	Amount      float64
+}
+
+type ReportRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewReportRepository(pool *pgxpool.Pool) *ReportRepository {
+	return &ReportRepository{pool: pool}
+}
+
+var (
+	hasPaidPurchase      = sq.Expr("EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", PurchaseStatusPaid)
+	hasNoPaidPurchase    = sq.Expr("NOT EXISTS (SELECT 1 FROM purchase p WHERE p.customer_id = customer.id AND p.status = ?)", PurchaseStatusPaid)
+	hasEarlierPurchase   = sq.Expr("EXISTS (SELECT 1 FROM purchase e WHERE e.customer_id = purchase.customer_id AND e.status = ? AND e.paid_at < purchase.paid_at)", PurchaseStatusPaid)
+	hasNoEarlierPurchase = sq.Expr("NOT EXISTS (SELECT 1 FROM purchase e WHERE e.customer_id = purchase.customer_id AND e.status = ? AND e.paid_at < purchase.paid_at)", PurchaseStatusPaid)
+)
+
+// Build computes the report of the period. A trial lasts trialDays, so the conversion is measured on the trials
+// that ended within the period.
+func (r *ReportRepository) Build(ctx context.Context, from, to time.Time, trialDays int) (*Report, error) {
+	report := &Report{From: from, To: to}
+	now := time.Now()
+	trialFrom, trialTo := from.AddDate(0, 0, -trialDays), to.AddDate(0, 0, -trialDays)
+	paidInPeriod := sq.And{sq.Eq{"status": PurchaseStatusPaid}, sq.GtOrEq{"paid_at": from}, sq.Lt{"paid_at": to}}
+
+	counts := []struct {
+		target     *int
+		table      string
+		conditions sq.Sqlizer
+	}{
+		{&report.NewUsers, "customer", sq.And{sq.GtOrEq{"created_at": from}, sq.Lt{"created_at": to}}},
+		{&report.Referrals, "referral", sq.And{sq.GtOrEq{"used_at": from}, sq.Lt{"used_at": to}}},
+		{&report.TrialsStarted, "customer", sq.And{sq.GtOrEq{"trial_used_at": from}, sq.Lt{"trial_used_at": to}}},
+		{&report.TrialsEnded, "customer", sq.And{sq.GtOrEq{"trial_used_at": trialFrom}, sq.Lt{"trial_used_at": trialTo}}},
+		{&report.TrialsConverted, "customer", sq.And{sq.GtOrEq{"trial_used_at": trialFrom}, sq.Lt{"trial_used_at": trialTo}, hasPaidPurchase}},
+		{&report.FirstPurchases, "purchase", sq.And{paidInPeriod, hasNoEarlierPurchase}},
+		{&report.Renewals, "purchase", sq.And{paidInPeriod, hasEarlierPurchase}},
+		{&report.ActiveSubscriptions, "customer", sq.And{sq.Eq{"archived_at": nil}, sq.Gt{"expire_at": now}}},
+		{&report.ActivePaid, "customer", sq.And{sq.Eq{"archived_at": nil}, sq.Gt{"expire_at": now}, hasPaidPurchase}},
+		{&report.Churned, "customer", sq.And{sq.GtOrEq{"expire_at": from}, sq.Lt{"expire_at": to}, sq.Lt{"expire_at": now}, hasPaidPurchase}},
+		{&report.ExpiredTrials, "customer", sq.And{sq.GtOrEq{"expire_at": from}, sq.Lt{"expire_at": to}, sq.Lt{"expire_at": now}, hasNoPaidPurchase}},
+	}
+	for _, c := range counts {
+		count, err := r.count(ctx, c.table, c.conditions)
+		if err != nil {
+			return nil, err
+		}
+		*c.target = count
+	}
+
+	revenue, err := r.revenue(ctx, paidInPeriod)
+	if err != nil {
+		return nil, err
+	}
+	report.Revenue = revenue
+	return report, nil
+}
+
+func (r *ReportRepository) count(ctx context.Context, table string, conditions sq.Sqlizer) (int, error) {
+	buildSelect := sq.Select("COUNT(*)").
+		From(table).
+		Where(conditions).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build count %s query: %w", table, err)
+	}
+
+	var count int
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count %s: %w", table, err)
+	}
+	return count, nil
+}
+
+func (r *ReportRepository) revenue(ctx context.Context, conditions sq.Sqlizer) ([]Revenue, error) {
+	buildSelect := sq.Select("COALESCE(invoice_type, '')", "COALESCE(currency, '')", "COUNT(*)", "SUM(amount)").
+		From("purchase").
+		Where(conditions).
+		GroupBy("1", "2").
+		OrderBy("1", "2").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select revenue query: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revenue: %w", err)
+	}
+	defer rows.Close()
+
+	var revenue []Revenue
+	for rows.Next() {
+		var rev Revenue
+		if err := rows.Scan(&rev.InvoiceType, &rev.Currency, &rev.Purchases, &rev.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan revenue row: %w", err)
+		}
+		revenue = append(revenue, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over revenue rows: %w", err)
+	}
+	return revenue, nil
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+const (
+	SyncTriggerCron  = "cron"
+	SyncTriggerAdmin = "admin"
+)
+
+type SyncRun struct {
+	ID         int64     `db:"id"`
+	Trigger    string    `db:"trigger"`
+	StartedAt  time.Time `db:"started_at"`
+	FinishedAt time.Time `db:"finished_at"`
+	PanelUsers int       `db:"panel_users"`
+	Created    int       `db:"created"`
+	Updated    int       `db:"updated"`
+	Restored   int       `db:"restored"`
+	Archived   int       `db:"archived"`
+	Error      *string   `db:"error"`
+}
+
+type SyncRunRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewSyncRunRepository(pool *pgxpool.Pool) *SyncRunRepository {
+	return &SyncRunRepository{pool: pool}
+}
+
+func (r *SyncRunRepository) Create(ctx context.Context, run *SyncRun) error {
+	buildInsert := sq.Insert("sync_run").
+		Columns("trigger", "started_at", "finished_at", "panel_users", "created", "updated", "restored", "archived", "error").
+		Values(run.Trigger, run.StartedAt, run.FinishedAt, run.PanelUsers, run.Created, run.Updated, run.Restored, run.Archived, run.Error).
+		Suffix("RETURNING id").
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := buildInsert.ToSql()
+	if err != nil {
+		return fmt.Errorf("failed to build insert sync run query: %w", err)
+	}
+
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&run.ID); err != nil {
+		return fmt.Errorf("failed to insert sync run: %w", err)
+	}
+	return nil
+}
+
+func (r *SyncRunRepository) FindLast(ctx context.Context) (*SyncRun, error) {
+	buildSelect := sq.Select("id", "trigger", "started_at", "finished_at", "panel_users", "created", "updated", "restored", "archived", "error").
+		From("sync_run").
+		OrderBy("finished_at DESC").
+		Limit(1)
+
+	sql, args, err := buildSelect.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build select sync run query: %w", err)
+	}
+
+	var run SyncRun
+	err = r.pool.QueryRow(ctx, sql, args...).Scan(
+		&run.ID, &run.Trigger, &run.StartedAt, &run.FinishedAt, &run.PanelUsers,
+		&run.Created, &run.Updated, &run.Restored, &run.Archived, &run.Error)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query last sync run: %w", err)
+	}
+	return &run, nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type TrialRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewTrialRepository(pool *pgxpool.Pool) *TrialRepository {
+	return &TrialRepository{pool: pool}
+}
+
+func (r *TrialRepository) IsUsed(ctx context.Context, telegramId int64) (bool, error) {
+	query := sq.Select("COUNT(*)").
+		From("trial_ledger").
+		Where(sq.Eq{"telegram_id": telegramId}).
+		PlaceholderFormat(sq.Dollar)
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return false, fmt.Errorf("failed to build select trial ledger query: %w", err)
+	}
+
+	var count int
+	if err := r.pool.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to query trial ledger: %w", err)
+	}
+	return count > 0, nil
+}
+
+// Claim atomically records the trial for the telegram id. It returns false when the trial
+// has already been claimed, so concurrent activations can't both succeed.
+func (r *TrialRepository) Claim(ctx context.Context, telegramId int64) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx,
+		"INSERT INTO trial_ledger (telegram_id) VALUES ($1) ON CONFLICT (telegram_id) DO NOTHING",
+		telegramId)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert trial ledger: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE customer SET trial_used_at = NOW() WHERE telegram_id = $1", telegramId)
+	if err != nil {
+		return false, fmt.Errorf("failed to update customer trial: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// Release reverts Claim when the trial could not be provisioned.
+func (r *TrialRepository) Release(ctx context.Context, telegramId int64) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM trial_ledger WHERE telegram_id = $1", telegramId); err != nil {
+		return fmt.Errorf("failed to delete trial ledger: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE customer SET trial_used_at = NULL WHERE telegram_id = $1", telegramId); err != nil {
+		return fmt.Errorf("failed to update customer trial: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -2,17 +2,22 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
 	"remnawave-tg-shop-bot/internal/broadcast"
 	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/timezone"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// PMCommandHandler обрабатывает команду /pm для рассылки сообщений всем пользователям
+// PMCommandHandler обрабатывает команду /pm для рассылки сообщений всем пользователям.
+// Рассылка не уходит сразу: админ видит предпросмотр и размер аудитории и подтверждает отправку.
 func (h Handler) PMCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	// Проверяем, что команда отправлена администратором
 	if update.Message.From.ID != config.GetAdminTelegramId() {
@@ -23,120 +28,497 @@ func (h Handler) PMCommandHandler(ctx context.Context, b *bot.Bot, update *model
 
 	// Парсим текст сообщения, убирая /pm
 	messageText := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, "/pm"))
-	
-	// Проверяем, что после команды есть текст для отправки
-	if messageText == "" {
-		// Отправляем инструкцию по использованию
-		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Использование: `/pm текст сообщения`\nТекст будет отправлен всем пользователям бота.",
-			ParseMode: models.ParseModeMarkdown,
-		})
-		if err != nil {
-			slog.Error("Error sending PM usage instructions", err)
+
+	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
+	draft, err := broadcastRepo.CreateDraft(ctx, update.Message.From.ID)
+	if err != nil {
+		slog.Error("Error creating broadcast draft", "error", err)
+		h.sendAdminText(ctx, b, update.Message.Chat.ID, "Произошла ошибка при создании рассылки.")
+		return
+	}
+
+	// Текст после команды сразу становится содержимым черновика
+	if messageText != "" {
+		draft.Message = messageText
+		draft.ComposeStep = nil
+		if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+			slog.Error("Error updating broadcast draft", "error", err)
+			return
 		}
+		h.sendBroadcastDraft(ctx, b, update.Message.Chat.ID, draft)
 		return
 	}
 
-	// Создаем запись о рассылке в базе данных
-	broadcastMsg := &broadcast.Broadcast{
-		SenderID: update.Message.From.ID,
-		Message:  messageText,
-		Status:   broadcast.BroadcastStatusPending,
+	// Без текста начинаем составление рассылки из сообщения админа
+	keyboard := [][]models.InlineKeyboardButton{
+		{{Text: "❌ Отменить", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastCancel, draft.ID)}},
 	}
+	text := "Отправьте сообщение для рассылки: текст, фото, видео, документ или альбом. " +
+		"Оно будет скопировано пользователям с форматированием и медиа, не удаляйте его до завершения рассылки.\n\n" +
+		"Для простой текстовой рассылки: `/pm текст сообщения`"
 
-	// Сохраняем запись в базу
+	scheduled, err := broadcastRepo.FindScheduled(ctx)
+	if err != nil {
+		slog.Error("Error finding scheduled broadcasts", "error", err)
+	}
+	if len(scheduled) > 0 {
+		text += "\n\nЗапланированные рассылки можно отменить кнопками ниже."
+		for _, s := range scheduled {
+			keyboard = append(keyboard, []models.InlineKeyboardButton{{
+				Text:         fmt.Sprintf("🗑 #%d на %s", s.ID, formatBroadcastTime(*s.ScheduledAt)),
+				CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastCancel, s.ID),
+			}})
+		}
+	}
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      update.Message.Chat.ID,
+		Text:        text,
+		ParseMode:   models.ParseModeMarkdown,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	if err != nil {
+		slog.Error("Error sending PM usage instructions", "error", err)
+	}
+}
+
+// BroadcastDraftMessageHandler принимает сообщения админа для черновика рассылки: само сообщение
+// или, после нажатия «Кнопки», «Аудитория» или «Запланировать», текст с кнопками, фильтр или время отправки.
+// Без черновика сообщения игнорируются.
+func (h Handler) BroadcastDraftMessageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	message := update.Message
 	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
-	broadcastId, err := broadcastRepo.Create(ctx, broadcastMsg)
-	
+	draft, err := broadcastRepo.FindDraft(ctx, message.From.ID)
 	if err != nil {
-		slog.Error("Error creating broadcast record", err)
+		slog.Error("Error finding broadcast draft", "error", err)
+		return
+	}
+	if draft == nil {
+		return
+	}
+
+	if draft.ComposeStep != nil && *draft.ComposeStep == broadcast.ComposeStepSchedule {
+		at, err := parseBroadcastTime(message.Text, time.Now().In(broadcastLocation()))
+		if err != nil {
+			h.sendAdminText(ctx, b, message.Chat.ID, fmt.Sprintf("Не удалось разобрать время: %v. Отправьте его еще раз.", err))
+			return
+		}
+		if err := broadcastRepo.Schedule(ctx, draft.ID, at); err != nil {
+			slog.Error("Error scheduling broadcast", "error", err)
+			h.sendAdminText(ctx, b, message.Chat.ID, "Произошла ошибка при планировании рассылки.")
+			return
+		}
+
 		_, err = b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Произошла ошибка при создании рассылки.",
+			ChatID: message.Chat.ID,
+			Text: fmt.Sprintf("🕒 Рассылка #%d запланирована на %s, %s. Аудитория будет выбрана в момент отправки.",
+				draft.ID, formatBroadcastTime(at), timezone.Label(config.DefaultTimezone())),
+			ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: "✅ Отправить сейчас", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastSend, draft.ID)}},
+				{{Text: "❌ Отменить", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastCancel, draft.ID)}},
+			}},
 		})
+		if err != nil {
+			slog.Error("Error sending broadcast schedule confirmation", "error", err)
+		}
+		return
+	}
+
+	if draft.ComposeStep != nil && *draft.ComposeStep == broadcast.ComposeStepAudience {
+		audience, err := broadcast.ParseAudience(message.Text)
+		if err != nil {
+			h.sendAdminText(ctx, b, message.Chat.ID, fmt.Sprintf("Не удалось разобрать фильтр: %v. Отправьте его еще раз.", err))
+			return
+		}
+		filter := audience.String()
+		draft.Audience = &filter
+		draft.ComposeStep = nil
+		if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+			slog.Error("Error updating broadcast draft", "error", err)
+			return
+		}
+		h.sendBroadcastDraft(ctx, b, message.Chat.ID, draft)
+		return
+	}
+
+	if draft.ComposeStep != nil && *draft.ComposeStep == broadcast.ComposeStepButtons && !draft.IsAlbum() {
+		buttons, err := parseBroadcastButtons(message.Text)
+		if err != nil {
+			h.sendAdminText(ctx, b, message.Chat.ID, fmt.Sprintf("Не удалось разобрать кнопки: %v. Отправьте их еще раз.", err))
+			return
+		}
+		draft.Buttons = buttons
+		draft.ComposeStep = nil
+		if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+			slog.Error("Error updating broadcast draft", "error", err)
+			return
+		}
+		h.sendBroadcastDraft(ctx, b, message.Chat.ID, draft)
+		return
+	}
+
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+	draft, err = broadcastRepo.AddSourceMessage(ctx, draft.ID, message.Chat.ID, int64(message.ID), nullableString(message.MediaGroupID), text)
+	if err != nil {
+		slog.Error("Error saving broadcast draft message", "error", err)
+		return
+	}
+	// действия показываются один раз, а не на каждое сообщение альбома
+	if draft != nil && len(draft.SourceMessageIDs) == 1 {
+		h.sendBroadcastDraft(ctx, b, message.Chat.ID, draft)
+	}
+}
+
+// BroadcastButtonsCallbackHandler переводит черновик в режим ожидания кнопок
+func (h Handler) BroadcastButtonsCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
+	draft := h.findBroadcastDraft(ctx, b, update)
+	if draft == nil {
+		return
+	}
+
+	step := broadcast.ComposeStepButtons
+	draft.ComposeStep = &step
+	if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+		slog.Error("Error updating broadcast draft", "error", err)
+		return
+	}
+
+	h.editAdminText(ctx, b, update, "Отправьте кнопки: каждая строка — ряд, кнопки в ряду разделяются ` | `.\n\n"+
+		"`Текст - https://example.com` — кнопка-ссылка\n"+
+		"`Текст - buy` — кнопка бота, например buy, connect, trial, referral или start")
+}
+
+// BroadcastAudienceCallbackHandler переводит черновик в режим ожидания фильтра аудитории
+func (h Handler) BroadcastAudienceCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
+	draft := h.findBroadcastDraft(ctx, b, update)
+	if draft == nil {
+		return
+	}
+
+	step := broadcast.ComposeStepAudience
+	draft.ComposeStep = &step
+	if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+		slog.Error("Error updating broadcast draft", "error", err)
+		return
+	}
+
+	h.editAdminText(ctx, b, update, "Отправьте фильтр аудитории.\n\n"+broadcast.AudienceHelp)
+}
+
+// BroadcastPreviewCallbackHandler показывает админу рассылку так, как ее увидят получатели,
+// и размер аудитории, после чего рассылку можно отправить сейчас, запланировать или отменить
+func (h Handler) BroadcastPreviewCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	draft := h.findBroadcastDraft(ctx, b, update)
+	if draft == nil {
+		return
+	}
+	if len(draft.SourceMessageIDs) == 0 && draft.Message == "" {
+		h.editAdminText(ctx, b, update, "Черновик пуст: сначала отправьте сообщение для рассылки.")
+		return
+	}
+
+	chatID := update.CallbackQuery.From.ID
+	if err := broadcast.Send(ctx, b, *draft, chatID); err != nil {
+		slog.Error("Error sending broadcast preview", "error", err)
+		h.sendAdminText(ctx, b, chatID, fmt.Sprintf("Не удалось показать предпросмотр: %v", err))
+		return
+	}
+
+	audience, recipients, err := h.countBroadcastAudience(ctx, draft, chatID)
+	if err != nil {
+		slog.Error("Error counting broadcast audience", "error", err)
 		return
 	}
 
-	// Отправляем подтверждение о начале рассылки
 	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   "Начинаю рассылку сообщения всем пользователям...",
+		ChatID: chatID,
+		Text:   fmt.Sprintf("👆 Так рассылку #%d увидят получатели.\nАудитория: %s — получателей: %d", draft.ID, audience, recipients),
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: fmt.Sprintf("✅ Отправить сейчас (%d)", recipients), CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastSend, draft.ID)}},
+			{{Text: "🕒 Запланировать", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastSchedule, draft.ID)}},
+			{{Text: "❌ Отменить", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastCancel, draft.ID)}},
+		}},
 	})
 	if err != nil {
-		slog.Error("Error sending broadcast confirmation", err)
+		slog.Error("Error sending broadcast confirmation", "error", err)
+	}
+}
+
+// BroadcastScheduleCallbackHandler переводит черновик в режим ожидания времени отправки
+func (h Handler) BroadcastScheduleCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
+	draft := h.findBroadcastDraft(ctx, b, update)
+	if draft == nil {
+		return
 	}
 
-	// Получаем всех подписчиков, кроме админа
-	subscribers, err := broadcastRepo.GetAllSubscribers(ctx, update.Message.From.ID)
+	step := broadcast.ComposeStepSchedule
+	draft.ComposeStep = &step
+	if err := broadcastRepo.UpdateDraft(ctx, draft); err != nil {
+		slog.Error("Error updating broadcast draft", "error", err)
+		return
+	}
+
+	h.editAdminText(ctx, b, update, fmt.Sprintf("Отправьте время рассылки, часовой пояс %s:\n\n"+
+		"`ДД.ММ.ГГГГ ЧЧ:ММ` — дата и время\n"+
+		"`ЧЧ:ММ` — ближайшее такое время, сегодня или завтра", timezone.Label(config.DefaultTimezone())))
+}
+
+// BroadcastSendCallbackHandler ставит черновик или запланированную рассылку в очередь на отправку сейчас
+func (h Handler) BroadcastSendCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
+	draft := h.findBroadcast(ctx, b, update, broadcast.BroadcastStatusDraft, broadcast.BroadcastStatusScheduled)
+	if draft == nil {
+		return
+	}
+	if len(draft.SourceMessageIDs) == 0 && draft.Message == "" {
+		h.editAdminText(ctx, b, update, "Черновик пуст: сначала отправьте сообщение для рассылки.")
+		return
+	}
+
+	total, err := broadcastRepo.Enqueue(ctx, draft.ID, update.CallbackQuery.From.ID)
+	if errors.Is(err, broadcast.ErrNotDraft) {
+		h.editAdminText(ctx, b, update, "Рассылка уже отправлена или отменена.")
+		return
+	}
 	if err != nil {
-		slog.Error("Error getting subscribers", err)
-		_, err = b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Ошибка при получении списка подписчиков.",
-		})
+		slog.Error("Error enqueueing broadcast", "error", err)
+		h.editAdminText(ctx, b, update, "Произошла ошибка при создании рассылки.")
 		return
 	}
 
-	// Запускаем асинхронную рассылку
-	go h.processBroadcast(context.Background(), b, broadcastId, messageText, subscribers, update.Message.From.ID)
+	h.editAdminText(ctx, b, update, fmt.Sprintf("🚀 Рассылка #%d поставлена в очередь, получателей: %d. "+
+		"Ход рассылки и кнопка остановки появятся ниже, отчет придет по ее завершении.", draft.ID, total))
 }
 
-// processBroadcast асинхронно отправляет сообщение всем подписчикам
-func (h *Handler) processBroadcast(ctx context.Context, b *bot.Bot, broadcastId int64, message string, subscribers []int64, adminId int64) {
+// BroadcastCancelCallbackHandler удаляет черновик или запланированную рассылку
+func (h Handler) BroadcastCancelCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	broadcastRepo := broadcast.NewBroadcastRepository(h.customerRepository.GetPool())
-	
-	totalCount := len(subscribers)
-	successCount := 0
-	failCount := 0
-	
-	// Ограничение скорости отправки (29 сообщений в секунду максимум)
-	rateLimitDelay := time.Millisecond * 35
-
-	for _, subscriberId := range subscribers {
-		_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: subscriberId,
-			Text:   message,
-			ParseMode: models.ParseModeHTML, // Поддержка HTML форматирования
-		})
+	draft := h.findBroadcast(ctx, b, update, broadcast.BroadcastStatusDraft, broadcast.BroadcastStatusScheduled)
+	if draft == nil {
+		return
+	}
 
-		if err != nil {
-			slog.Error("Error sending broadcast to user", 
-				"userId", subscriberId, 
-				"error", err)
-			failCount++
-		} else {
-			successCount++
-		}
+	cancelled, err := broadcastRepo.Cancel(ctx, draft.ID)
+	if err != nil {
+		slog.Error("Error cancelling broadcast", "error", err)
+		return
+	}
+	if !cancelled {
+		h.editAdminText(ctx, b, update, "Рассылка уже началась, ее можно только остановить.")
+		return
+	}
+	h.editAdminText(ctx, b, update, fmt.Sprintf("Рассылка #%d отменена.", draft.ID))
+}
+
+// BroadcastStopCallbackHandler останавливает идущую рассылку. Итоги покажет обработчик очереди,
+// когда закончит отправку текущему получателю.
+func (h Handler) BroadcastStopCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	id, err := strconv.ParseInt(parseCallbackData(update.CallbackQuery.Data)["id"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing broadcast id", "data", update.CallbackQuery.Data, "error", err)
+		return
+	}
+
+	stopped, err := broadcast.NewBroadcastRepository(h.customerRepository.GetPool()).Stop(ctx, id)
+	if err != nil {
+		slog.Error("Error stopping broadcast", "error", err)
+		return
+	}
+
+	text := "⏹ Рассылка останавливается"
+	if !stopped {
+		text = "Рассылка уже завершена"
+	}
+	_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+		Text:            text,
+	})
+	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+}
+
+// findBroadcastDraft возвращает черновик из данных кнопки или nil, если он уже отправлен или удален
+func (h Handler) findBroadcastDraft(ctx context.Context, b *bot.Bot, update *models.Update) *broadcast.Broadcast {
+	return h.findBroadcast(ctx, b, update, broadcast.BroadcastStatusDraft)
+}
+
+// findBroadcast возвращает рассылку из данных кнопки или nil, если она уже не в одном из статусов statuses
+func (h Handler) findBroadcast(ctx context.Context, b *bot.Bot, update *models.Update, statuses ...string) *broadcast.Broadcast {
+	id, err := strconv.ParseInt(parseCallbackData(update.CallbackQuery.Data)["id"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing broadcast id", "data", update.CallbackQuery.Data, "error", err)
+		return nil
+	}
+
+	draft, err := broadcast.NewBroadcastRepository(h.customerRepository.GetPool()).FindByID(ctx, id)
+	if err != nil {
+		slog.Error("Error finding broadcast draft", "error", err)
+		return nil
+	}
+	if draft == nil || !slices.Contains(statuses, draft.Status) {
+		h.editAdminText(ctx, b, update, "Черновик уже отправлен или удален.")
+		return nil
+	}
+	return draft
+}
 
-		// Задержка для соблюдения ограничений API Telegram
-		time.Sleep(rateLimitDelay)
+// countBroadcastAudience возвращает аудиторию рассылки и число ее получателей
+func (h Handler) countBroadcastAudience(ctx context.Context, draft *broadcast.Broadcast, adminID int64) (*broadcast.Audience, int, error) {
+	audience, err := draft.ParsedAudience()
+	if err != nil {
+		return nil, 0, err
+	}
+	recipients, err := broadcast.NewBroadcastRepository(h.customerRepository.GetPool()).CountAudience(ctx, audience, adminID)
+	if err != nil {
+		return nil, 0, err
 	}
+	return audience, recipients, nil
+}
 
-	// Обновляем статус рассылки
-	status := broadcast.BroadcastStatusSent
-	if failCount > 0 && failCount == totalCount {
-		status = broadcast.BroadcastStatusFailed
+// sendBroadcastDraft показывает админу действия с черновиком
+func (h Handler) sendBroadcastDraft(ctx context.Context, b *bot.Bot, chatID int64, draft *broadcast.Broadcast) {
+	buttonsCount := 0
+	for _, row := range draft.Buttons {
+		buttonsCount += len(row)
 	}
-	
-	err := broadcastRepo.UpdateStatus(ctx, broadcastId, status)
+
+	audience, recipients, err := h.countBroadcastAudience(ctx, draft, chatID)
 	if err != nil {
-		slog.Error("Error updating broadcast status", err)
+		slog.Error("Error counting broadcast audience", "error", err)
+		return
 	}
 
-	// Отправляем отчет администратору
-	summary := fmt.Sprintf(
-		"📊 Отчет о рассылке:\n\n"+
-		"✅ Успешно отправлено: %d\n"+
-		"❌ Ошибок при отправке: %d\n"+
-		"📨 Всего получателей: %d",
-		successCount, failCount, totalCount)
+	text := fmt.Sprintf("📝 Черновик рассылки #%d сохранен. Кнопок: %d\nАудитория: %s — получателей: %d",
+		draft.ID, buttonsCount, audience, recipients)
+	audienceButton := models.InlineKeyboardButton{Text: "👥 Аудитория", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastAudience, draft.ID)}
+	var keyboard [][]models.InlineKeyboardButton
+	if draft.IsAlbum() {
+		text += "\nК альбому нельзя добавить кнопки."
+		keyboard = append(keyboard, []models.InlineKeyboardButton{audienceButton})
+	} else {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: "➕ Кнопки", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastButtons, draft.ID)},
+			audienceButton,
+		})
+	}
+	keyboard = append(keyboard,
+		[]models.InlineKeyboardButton{{Text: "👁 Предпросмотр", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastPreview, draft.ID)}},
+		[]models.InlineKeyboardButton{{Text: "❌ Отменить", CallbackData: fmt.Sprintf("%s?id=%d", CallbackBroadcastCancel, draft.ID)}},
+	)
 
 	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: adminId,
-		Text:   summary,
+		ChatID:      chatID,
+		Text:        text,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	if err != nil {
+		slog.Error("Error sending broadcast draft", "error", err)
+	}
+}
+
+func (h Handler) sendAdminText(ctx context.Context, b *bot.Bot, chatID int64, text string) {
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   text,
 	})
 	if err != nil {
-		slog.Error("Error sending broadcast summary", err)
+		slog.Error("Error sending message", "error", err)
+	}
+}
+
+func (h Handler) editAdminText(ctx context.Context, b *bot.Bot, update *models.Update, text string) {
+	callback := update.CallbackQuery.Message.Message
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		Text:      text,
+		ParseMode: models.ParseModeMarkdown,
+	})
+	if err != nil {
+		slog.Error("Error editing message", "error", err)
+	}
+}
+
+// parseBroadcastButtons разбирает кнопки рассылки: строка — ряд, кнопки ряда разделены " | ",
+// каждая кнопка задается как "Текст - ссылка" или "Текст - callback".
+func parseBroadcastButtons(text string) ([][]models.InlineKeyboardButton, error) {
+	var keyboard [][]models.InlineKeyboardButton
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var row []models.InlineKeyboardButton
+		for _, item := range strings.Split(line, "|") {
+			label, target, found := cutLast(item, " - ")
+			label, target = strings.TrimSpace(label), strings.TrimSpace(target)
+			if !found || label == "" || target == "" {
+				return nil, fmt.Errorf("строка %d: ожидается «Текст - ссылка»", i+1)
+			}
+
+			button := models.InlineKeyboardButton{Text: label}
+			switch {
+			case strings.HasPrefix(target, "https://"), strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "tg://"):
+				button.URL = target
+			case len(target) > 64 || strings.ContainsAny(target, " \t"):
+				return nil, fmt.Errorf("строка %d: данные кнопки %q длиннее 64 байт или содержат пробелы", i+1, target)
+			default:
+				button.CallbackData = target
+			}
+			row = append(row, button)
+		}
+		keyboard = append(keyboard, row)
+	}
+	if len(keyboard) == 0 {
+		return nil, fmt.Errorf("нет ни одной кнопки")
+	}
+	return keyboard, nil
+}
+
+// parseBroadcastTime разбирает время рассылки "02.01.2006 15:04" или "15:04" в часовом поясе now.
+// Для времени без даты выбирается ближайшее в будущем.
+func parseBroadcastTime(text string, now time.Time) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if at, err := time.ParseInLocation(broadcastTimeLayout, text, now.Location()); err == nil {
+		if !at.After(now) {
+			return time.Time{}, fmt.Errorf("время %s уже прошло", formatBroadcastTime(at))
+		}
+		return at, nil
+	}
+
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ожидается «ДД.ММ.ГГГГ ЧЧ:ММ» или «ЧЧ:ММ»")
+	}
+	at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !at.After(now) {
+		at = at.AddDate(0, 0, 1)
 	}
-}
\ No newline at end of file
+	return at, nil
+}
+
+const broadcastTimeLayout = "02.01.2006 15:04"
+
+func formatBroadcastTime(t time.Time) string {
+	return t.In(broadcastLocation()).Format(broadcastTimeLayout)
+}
+
+// broadcastLocation — часовой пояс, в котором админ указывает время рассылки
+func broadcastLocation() *time.Location {
+	return timezone.Load(config.DefaultTimezone())
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -1,5 +1,10 @@
 package handler
 
+import (
+	"remnawave-tg-shop-bot/internal/broadcast"
+	"remnawave-tg-shop-bot/internal/payment"
+)
+
 const (
 	CallbackBuy           = "buy"
 	CallbackSell          = "sell"
@@ -9,4 +14,22 @@ const (
 	CallbackTrial         = "trial"
 	CallbackActivateTrial = "activate_trial"
 	CallbackReferral      = "referral"
+	CallbackCheckChannel  = "check_channel"
+	CallbackClaimReferral = payment.CallbackClaimReferral
+	CallbackResetLink     = "reset_link"
+	CallbackConfirmReset  = "reset_link_confirm"
+	CallbackServerStatus  = "server_status"
+	CallbackSettings      = "settings"
+	CallbackSetTimezone   = "set_tz"
+
+	CallbackMergeDuplicate   = "dup_merge"
+	CallbackCleanupDuplicate = "dup_clean"
+
+	CallbackBroadcastButtons  = "bc_buttons"
+	CallbackBroadcastSend     = "bc_send"
+	CallbackBroadcastCancel   = "bc_cancel"
+	CallbackBroadcastAudience = "bc_audience"
+	CallbackBroadcastPreview  = "bc_preview"
+	CallbackBroadcastSchedule = "bc_schedule"
+	CallbackBroadcastStop     = broadcast.CallbackStop
 )
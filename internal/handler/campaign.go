@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"strings"
+)
+
+// CampaignsCommandHandler handles /campaigns, the delivery and conversion stats of the win-back campaigns.
+func (h Handler) CampaignsCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	stats, err := h.campaignRepository.Stats(ctx)
+	if err != nil {
+		slog.Error("Error getting campaign stats", "error", err)
+		h.sendSyncMessage(ctx, b, update.Message.Chat.ID, fmt.Sprintf("❌ Failed to get campaign stats: %s", err))
+		return
+	}
+
+	var text strings.Builder
+	text.WriteString("🎯 <b>Win-back campaigns</b>\n\n")
+	if len(config.Campaigns()) == 0 {
+		text.WriteString("No campaigns configured, see WINBACK_CAMPAIGNS\n\n")
+	}
+	for _, campaign := range config.Campaigns() {
+		text.WriteString(fmt.Sprintf("<b>%s</b>: %s, %d days", campaign.Name, campaign.Segment, campaign.Days))
+		if campaign.Discount > 0 {
+			text.WriteString(fmt.Sprintf(", %d%% off for %d days", campaign.Discount, campaign.DiscountDays))
+		}
+		text.WriteString("\n")
+	}
+
+	if len(stats) == 0 {
+		text.WriteString("\nNo messages sent yet")
+	}
+	for _, s := range stats {
+		rate := 0.0
+		if s.Sent > 0 {
+			rate = float64(s.Converted) * 100 / float64(s.Sent)
+		}
+		text.WriteString(fmt.Sprintf("\n%s: sent %d, converted %d (%.1f%%)", s.Campaign, s.Sent, s.Converted, rate))
+	}
+
+	h.sendSyncMessage(ctx, b, update.Message.Chat.ID, text.String())
+}
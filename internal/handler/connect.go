@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"math"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/payment"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"strings"
+	"time"
+)
+
+const progressBarLength = 10
+
+// buildLiveConnectText renders the Connect screen from the panel user and falls back to
+// the data cached in the customer row when the panel can't be reached.
+func (h Handler) buildLiveConnectText(ctx context.Context, customer *database.Customer, langCode string) string {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	user, err := h.panels.Get(customer.PanelID).GetUser(ctxWithTimeout, customer.RemnawaveUUID, customer.TelegramID)
+	if err != nil {
+		slog.Warn("Error getting panel user, using cached data", "telegramId", customer.TelegramID, "error", err)
+		return buildConnectText(customer, langCode) + h.translation.GetText(langCode, "subscription_stats_unavailable")
+	}
+	if user == nil {
+		return buildConnectText(customer, langCode)
+	}
+
+	h.refreshCachedSubscription(ctx, customer, user)
+
+	var info strings.Builder
+
+	status := user.Status.Or(remapi.UserDtoStatusACTIVE)
+	info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "connect_status"),
+		h.translation.GetText(langCode, "status_"+strings.ToLower(string(status)))))
+
+	location := customer.Location()
+	info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "connect_expire"),
+		user.ExpireAt.In(location).Format("02.01.2006 15:04"), daysRemaining(user.ExpireAt)))
+
+	limit := user.TrafficLimitBytes.Or(0)
+	if limit > 0 {
+		used := user.UsedTrafficBytes
+		info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "connect_traffic"),
+			FormatBytes(used), FormatBytes(float64(limit)), progressBar(used/float64(limit))))
+	} else {
+		info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "connect_traffic_unlimited"),
+			FormatBytes(user.UsedTrafficBytes)))
+	}
+
+	lastOnline := h.translation.GetText(langCode, "connect_never_online")
+	if onlineAt, ok := user.OnlineAt.Get(); ok {
+		lastOnline = onlineAt.In(location).Format("02.01.2006 15:04")
+	}
+	info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "connect_last_online"), lastOnline))
+
+	if user.SubscriptionUrl != "" && status != remapi.UserDtoStatusDISABLED {
+		info.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "subscription_link"), user.SubscriptionUrl))
+	}
+
+	return info.String()
+}
+
+func (h Handler) connectScreenKeyboard(customer *database.Customer, langCode string) [][]models.InlineKeyboardButton {
+	var keyboard [][]models.InlineKeyboardButton
+	if customer.SubscriptionLink != nil && *customer.SubscriptionLink != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "reset_link_button"), CallbackData: CallbackResetLink},
+		})
+	}
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart},
+	})
+	return keyboard
+}
+
+func (h Handler) ResetLinkCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      h.translation.GetText(langCode, "reset_link_confirm"),
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: h.translation.GetText(langCode, "reset_link_confirm_button"), CallbackData: CallbackConfirmReset}},
+				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackConnect}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending reset link confirmation", "error", err)
+	}
+}
+
+func (h Handler) ConfirmResetLinkCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return
+	}
+	if customer == nil {
+		slog.Error("customer not exist", "telegramId", update.CallbackQuery.From.ID)
+		return
+	}
+
+	subscriptionUrl, err := h.paymentService.ResetSubscriptionLink(ctx, customer)
+	if errors.Is(err, payment.ErrLinkResetTooSoon) && customer.LinkResetAt == nil {
+		// a concurrent first reset failed and released the claim, so there is no cooldown to show
+		h.answerServiceUnavailable(ctx, b, update.CallbackQuery.ID, langCode)
+		return
+	}
+	if errors.Is(err, payment.ErrLinkResetTooSoon) {
+		nextReset := customer.LinkResetAt.Add(config.LinkResetCooldown())
+		_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            fmt.Sprintf(h.translation.GetText(langCode, "reset_link_too_soon"), nextReset.In(customer.Location()).Format("02.01.2006 15:04")),
+			ShowAlert:       true,
+		})
+		if err != nil {
+			slog.Error("Error answering callback query", "error", err)
+		}
+		return
+	}
+	if errors.Is(err, remnawave.ErrUnavailable) {
+		h.answerServiceUnavailable(ctx, b, update.CallbackQuery.ID, langCode)
+		return
+	}
+	if err != nil {
+		slog.Error("Error resetting subscription link", "customerId", customer.ID, "error", err)
+		return
+	}
+
+	isDisabled := true
+	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      fmt.Sprintf(h.translation.GetText(langCode, "reset_link_done"), subscriptionUrl),
+		LinkPreviewOptions: &models.LinkPreviewOptions{
+			IsDisabled: &isDisabled,
+		},
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackConnect}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending reset link message", "error", err)
+	}
+}
+
+func (h Handler) refreshCachedSubscription(ctx context.Context, customer *database.Customer, user *remapi.UserDto) {
+	updates := map[string]interface{}{}
+	if customer.ExpireAt == nil || !customer.ExpireAt.Equal(user.ExpireAt) {
+		updates["expire_at"] = user.ExpireAt
+	}
+	if customer.SubscriptionLink == nil || *customer.SubscriptionLink != user.SubscriptionUrl {
+		updates["subscription_link"] = user.SubscriptionUrl
+	}
+	if err := h.customerRepository.UpdateFields(ctx, customer.ID, updates); err != nil {
+		slog.Error("Error refreshing cached subscription", "customerId", customer.ID, "error", err)
+	}
+}
+
+func daysRemaining(expireAt time.Time) int {
+	left := time.Until(expireAt)
+	if left <= 0 {
+		return 0
+	}
+	return int(math.Ceil(left.Hours() / 24))
+}
+
+func progressBar(ratio float64) string {
+	ratio = math.Max(0, math.Min(1, ratio))
+	filled := int(math.Round(ratio * progressBarLength))
+	return fmt.Sprintf("%s%s %d%%",
+		strings.Repeat("▰", filled), strings.Repeat("▱", progressBarLength-filled), int(math.Round(ratio*100)))
+}
+
+// FormatBytes renders the traffic in binary units, e.g. "1.50 GB".
+func FormatBytes(bytes float64) string {
+	const unit = 1024
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for bytes >= unit && i < len(units)-1 {
+		bytes /= unit
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[i])
+	}
+	return fmt.Sprintf("%.2f %s", bytes, units[i])
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/google/uuid"
+	"html"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/sync"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const duplicatesPerMessage = 10
+
+// DuplicatesCommandHandler handles /duplicates, the report of telegram ids with several panel users.
+func (h Handler) DuplicatesCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	go func() {
+		ctx := context.Background()
+		duplicates, err := h.syncService.FindDuplicates(ctx)
+		if err != nil {
+			slog.Error("Error finding duplicates", "error", err)
+			h.sendSyncMessage(ctx, b, chatID, fmt.Sprintf("❌ Failed to find duplicates: %s", html.EscapeString(err.Error())))
+			return
+		}
+		if len(duplicates) == 0 {
+			h.sendSyncMessage(ctx, b, chatID, "✅ No duplicate panel users found")
+			return
+		}
+
+		var text strings.Builder
+		text.WriteString(fmt.Sprintf("👥 <b>Duplicate panel users</b>: %d telegram ids\n\n", len(duplicates)))
+		text.WriteString("✅ is the user bound to the customer. <b>Merge</b> moves the latest expiration date to it and deletes the others, <b>Clean up</b> only deletes the others. Both ask for confirmation first.\n\n")
+
+		var keyboard [][]models.InlineKeyboardButton
+		for i, duplicate := range duplicates {
+			if i == duplicatesPerMessage {
+				text.WriteString(fmt.Sprintf("… and %d more, resolve these and run /duplicates again", len(duplicates)-duplicatesPerMessage))
+				break
+			}
+			text.WriteString(formatDuplicate(duplicate))
+			keep := duplicate.Users[duplicate.Keep].User.UUID
+			keyboard = append(keyboard, []models.InlineKeyboardButton{
+				{Text: fmt.Sprintf("Merge %d", duplicate.TelegramID), CallbackData: duplicateCallbackData(CallbackMergeDuplicate, duplicate.TelegramID, keep, "")},
+				{Text: fmt.Sprintf("Clean up %d", duplicate.TelegramID), CallbackData: duplicateCallbackData(CallbackCleanupDuplicate, duplicate.TelegramID, keep, "")},
+			})
+		}
+
+		_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:      chatID,
+			Text:        text.String(),
+			ParseMode:   models.ParseModeHTML,
+			ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+		})
+		if err != nil {
+			slog.Error("Error sending duplicates message", "error", err)
+		}
+	}()
+}
+
+// ResolveDuplicateCallbackHandler handles the merge and cleanup buttons of the /duplicates report. The first tap
+// shows the users that would be deleted, they are deleted only after the confirmation. The kept user is the one
+// the admin saw in the report, it is passed in the callback data together with the hash of the confirmed users.
+func (h Handler) ResolveDuplicateCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	merge := strings.HasPrefix(update.CallbackQuery.Data, CallbackMergeDuplicate)
+	data := parseCallbackData(update.CallbackQuery.Data)
+	telegramID, err := strconv.ParseInt(data["tg"], 10, 64)
+	if err != nil {
+		slog.Error("Error parsing telegram id", "data", update.CallbackQuery.Data, "error", err)
+		return
+	}
+	keepUUID, err := parseCallbackUUID(data["k"])
+	if err != nil {
+		slog.Error("Error parsing kept user uuid", "data", update.CallbackQuery.Data, "error", err)
+		return
+	}
+
+	_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: update.CallbackQuery.ID})
+	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+
+	if data["h"] == "" {
+		h.confirmResolveDuplicate(ctx, b, update.CallbackQuery.From.ID, telegramID, keepUUID, merge)
+		return
+	}
+
+	var text string
+	kept, deleted, err := h.syncService.ResolveDuplicate(ctx, telegramID, keepUUID, data["h"], merge)
+	switch {
+	case errors.Is(err, sync.ErrSyncInProgress):
+		text = "⏳ Sync is already running, try again later"
+	case errors.Is(err, sync.ErrDuplicateChanged):
+		text = fmt.Sprintf("⚠️ The panel users of <code>%d</code> changed since the confirmation, nothing was deleted. Run /duplicates again", telegramID)
+	case err != nil:
+		slog.Error("Error resolving duplicate", "telegramId", telegramID, "error", err)
+		text = fmt.Sprintf("❌ Failed to resolve duplicate of <code>%d</code>: %s", telegramID, html.EscapeString(err.Error()))
+	default:
+		text = fmt.Sprintf("✅ <code>%d</code>: kept %s, deleted %d user(s)\n\n%s",
+			telegramID, kept.User.Username, deleted, formatPanelUser(*kept, true))
+	}
+	h.sendSyncMessage(ctx, b, update.CallbackQuery.From.ID, text)
+}
+
+// confirmResolveDuplicate lists the panel users that the merge or cleanup would delete and asks to confirm.
+func (h Handler) confirmResolveDuplicate(ctx context.Context, b *bot.Bot, chatID int64, telegramID int64, keepUUID uuid.UUID, merge bool) {
+	users, err := h.syncService.DuplicateUsers(ctx, telegramID)
+	if err != nil {
+		slog.Error("Error finding duplicate users", "telegramId", telegramID, "error", err)
+		h.sendSyncMessage(ctx, b, chatID, fmt.Sprintf("❌ Failed to get panel users of <code>%d</code>: %s", telegramID, html.EscapeString(err.Error())))
+		return
+	}
+
+	action, callback := "Clean up", CallbackCleanupDuplicate
+	if merge {
+		action, callback = "Merge", CallbackMergeDuplicate
+	}
+
+	keep := slices.IndexFunc(users, func(user sync.PanelUser) bool { return user.User.UUID == keepUUID })
+	if keep < 0 {
+		h.sendSyncMessage(ctx, b, chatID, fmt.Sprintf("❌ The user <code>%s</code> of <code>%d</code> is not in the panel anymore, run /duplicates again", keepUUID, telegramID))
+		return
+	}
+
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("⚠️ <b>%s</b> <code>%d</code>?\n\nKeep:\n", action, telegramID))
+	text.WriteString(formatPanelUser(users[keep], true))
+	text.WriteString(fmt.Sprintf("<code>%s</code>\n\nDelete:\n", keepUUID))
+	for _, user := range users {
+		if user.User.UUID == keepUUID {
+			continue
+		}
+		text.WriteString(formatPanelUser(user, false))
+		text.WriteString(fmt.Sprintf("<code>%s</code>\n", user.User.UUID))
+	}
+
+	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    chatID,
+		Text:      text.String(),
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: fmt.Sprintf("✅ Confirm %s", strings.ToLower(action)), CallbackData: duplicateCallbackData(callback, telegramID, keepUUID, sync.UsersHash(users))}},
+		}},
+	})
+	if err != nil {
+		slog.Error("Error sending duplicate confirmation", "error", err)
+	}
+}
+
+// duplicateCallbackData encodes the uuid in base64 to fit the 64 bytes of callback data. The users hash is set
+// only on the confirmation button.
+func duplicateCallbackData(callback string, telegramID int64, keepUUID uuid.UUID, usersHash string) string {
+	data := fmt.Sprintf("%s?tg=%d&k=%s", callback, telegramID, base64.RawURLEncoding.EncodeToString(keepUUID[:]))
+	if usersHash != "" {
+		data += "&h=" + usersHash
+	}
+	return data
+}
+
+func parseCallbackUUID(value string) (uuid.UUID, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(bytes)
+}
+
+func formatDuplicate(duplicate sync.Duplicate) string {
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("<code>%d</code>", duplicate.TelegramID))
+	if duplicate.Profile != "" {
+		text.WriteString(" " + html.EscapeString(duplicate.Profile))
+	}
+	text.WriteString("\n")
+	for i, user := range duplicate.Users {
+		text.WriteString(formatPanelUser(user, i == duplicate.Keep))
+	}
+	text.WriteString("\n")
+	return text.String()
+}
+
+func formatPanelUser(user sync.PanelUser, kept bool) string {
+	mark := "➖"
+	if kept {
+		mark = "✅"
+	}
+	return fmt.Sprintf("%s %s / %s / %s / %s\n", mark, user.Panel, user.User.Username,
+		user.User.Status.Or(remapi.UserDtoStatusACTIVE), user.User.ExpireAt.Format("02.01.2006"))
+}
@@ -2,14 +2,18 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/channel"
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/cryptopay"
 	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/location"
 	"remnawave-tg-shop-bot/internal/payment"
+	"remnawave-tg-shop-bot/internal/remnawave"
 	"remnawave-tg-shop-bot/internal/sync"
 	"remnawave-tg-shop-bot/internal/translation"
 	"remnawave-tg-shop-bot/internal/yookasa"
@@ -27,6 +31,11 @@ type Handler struct {
 	paymentService     *payment.PaymentService
 	syncService        *sync.SyncService
 	referralRepository *database.ReferralRepository
+	trialRepository    *database.TrialRepository
+	channelService     *channel.Service
+	panels             *remnawave.Panels
+	locationService    *location.Service
+	campaignRepository *database.CampaignRepository
 }
 
 func NewHandler(
@@ -36,7 +45,12 @@ func NewHandler(
 	customerRepository *database.CustomerRepository,
 	purchaseRepository *database.PurchaseRepository,
 	cryptoPayClient *cryptopay.Client,
-	yookasaClient *yookasa.Client, referralRepository *database.ReferralRepository) *Handler {
+	yookasaClient *yookasa.Client, referralRepository *database.ReferralRepository,
+	trialRepository *database.TrialRepository,
+	channelService *channel.Service,
+	panels *remnawave.Panels,
+	locationService *location.Service,
+	campaignRepository *database.CampaignRepository) *Handler {
 	return &Handler{
 		syncService:        syncService,
 		paymentService:     paymentService,
@@ -46,6 +60,11 @@ func NewHandler(
 		yookasaClient:      yookasaClient,
 		translation:        translation,
 		referralRepository: referralRepository,
+		trialRepository:    trialRepository,
+		channelService:     channelService,
+		panels:             panels,
+		locationService:    locationService,
+		campaignRepository: campaignRepository,
 	}
 }
 
@@ -92,10 +111,7 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 	}
 
 	if existingCustomer == nil {
-		existingCustomer, err = h.customerRepository.Create(ctxWithTime, &database.Customer{
-			TelegramID: update.Message.Chat.ID,
-			Language:   langCode,
-		})
+		existingCustomer, err = h.customerRepository.Create(ctxWithTime, newCustomer(update.Message.Chat.ID, update.Message.From))
 		if err != nil {
 			slog.Error("error creating customer", err)
 			return
@@ -123,18 +139,14 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 			}
 		}
 	} else {
-		updates := map[string]interface{}{
-			"language": langCode,
-		}
-
-		err = h.customerRepository.UpdateFields(ctx, existingCustomer.ID, updates)
+		err = h.updateProfile(ctx, existingCustomer, update.Message.From)
 		if err != nil {
 			slog.Error("Error updating customer", err)
 			return
 		}
 	}
 
-	inlineKeyboard := h.buildStartKeyboard(existingCustomer, langCode)
+	inlineKeyboard := h.buildStartKeyboard(existingCustomer, h.isTrialAvailable(ctx, existingCustomer), langCode)
 
 	m, err := b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: update.Message.Chat.ID,
@@ -165,7 +177,7 @@ func (h Handler) StartCommandHandler(ctx context.Context, b *bot.Bot, update *mo
 		ReplyMarkup: models.InlineKeyboardMarkup{
 			InlineKeyboard: inlineKeyboard,
 		},
-		Text: h.translation.GetText(langCode, "greeting"),
+		Text: h.locationService.Greeting(ctx, langCode),
 	})
 	if err != nil {
 		slog.Error("Error sending /start message", err)
@@ -185,7 +197,7 @@ func (h Handler) StartCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	inlineKeyboard := h.buildStartKeyboard(existingCustomer, langCode)
+	inlineKeyboard := h.buildStartKeyboard(existingCustomer, h.isTrialAvailable(ctxWithTime, existingCustomer), langCode)
 
 	_, err = b.EditMessageText(ctxWithTime, &bot.EditMessageTextParams{ChatID: callback.Message.Message.Chat.ID,
 		MessageID: callback.Message.Message.ID,
@@ -193,7 +205,7 @@ func (h Handler) StartCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 		ReplyMarkup: models.InlineKeyboardMarkup{
 			InlineKeyboard: inlineKeyboard,
 		},
-		Text: h.translation.GetText(langCode, "greeting"),
+		Text: h.locationService.Greeting(ctxWithTime, langCode),
 	})
 	if err != nil {
 		slog.Error("Error sending /start message", err)
@@ -202,37 +214,33 @@ func (h Handler) StartCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 
 func (h Handler) CreateCustomerIfNotExistMiddleware(next bot.HandlerFunc) bot.HandlerFunc {
 	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
-		var telegramId int64
-		var langCode string
+		var user *models.User
 		if update.Message != nil {
-			telegramId = update.Message.From.ID
-			langCode = update.Message.From.LanguageCode
+			user = update.Message.From
 		} else if update.CallbackQuery != nil {
-			telegramId = update.CallbackQuery.From.ID
-			langCode = update.CallbackQuery.From.LanguageCode
+			user = &update.CallbackQuery.From
+		} else if update.PreCheckoutQuery != nil {
+			user = update.PreCheckoutQuery.From
+		}
+		if user == nil {
+			next(ctx, b, update)
+			return
 		}
-		existingCustomer, err := h.customerRepository.FindByTelegramId(ctx, telegramId)
+		existingCustomer, err := h.customerRepository.FindByTelegramId(ctx, user.ID)
 		if err != nil {
 			slog.Error("error finding customer by telegram id", err)
 			return
 		}
 
 		if existingCustomer == nil {
-			existingCustomer, err = h.customerRepository.Create(ctx, &database.Customer{
-				TelegramID: telegramId,
-				Language:   langCode,
-			})
+			existingCustomer, err = h.customerRepository.Create(ctx, newCustomer(user.ID, user))
 			if err != nil {
 				slog.Error("error creating customer", err)
 				return
 			}
-			slog.Info("user created", "telegramId", telegramId)
+			slog.Info("user created", "telegramId", user.ID)
 		} else {
-			updates := map[string]interface{}{
-				"language": langCode,
-			}
-
-			err = h.customerRepository.UpdateFields(ctx, existingCustomer.ID, updates)
+			err = h.updateProfile(ctx, existingCustomer, user)
 			if err != nil {
 				slog.Error("Error updating customer", err)
 				return
@@ -243,6 +251,60 @@ func (h Handler) CreateCustomerIfNotExistMiddleware(next bot.HandlerFunc) bot.Ha
 	}
 }
 
+func newCustomer(telegramId int64, user *models.User) *database.Customer {
+	customer := &database.Customer{TelegramID: telegramId, Language: user.LanguageCode}
+	setProfile(customer, user)
+	return customer
+}
+
+func setProfile(customer *database.Customer, user *models.User) {
+	customer.Username = nullableString(user.Username)
+	customer.FirstName = nullableString(user.FirstName)
+	customer.LastName = nullableString(user.LastName)
+	customer.IsPremium = user.IsPremium
+}
+
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// updateProfile stores the language and the telegram profile of the customer. A changed profile is pushed
+// to the description of the panel user in the background, so the handler doesn't wait for the panel.
+func (h Handler) updateProfile(ctx context.Context, customer *database.Customer, user *models.User) error {
+	previousProfile := customer.Profile()
+	customer.Language = user.LanguageCode
+	setProfile(customer, user)
+
+	updates := map[string]interface{}{
+		"language":   customer.Language,
+		"username":   customer.Username,
+		"first_name": customer.FirstName,
+		"last_name":  customer.LastName,
+		"is_premium": customer.IsPremium,
+	}
+	if err := h.customerRepository.UpdateFields(ctx, customer.ID, updates); err != nil {
+		return err
+	}
+
+	if customer.RemnawaveUUID != nil && customer.Profile() != previousProfile {
+		go h.pushProfile(*customer)
+	}
+	return nil
+}
+
+func (h Handler) pushProfile(customer database.Customer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := h.panels.Get(customer.PanelID).SetDescription(ctx, *customer.RemnawaveUUID, customer.Profile())
+	if err != nil {
+		slog.Error("Error updating panel user description", "telegramId", customer.TelegramID, "error", err)
+	}
+}
+
 func (h Handler) resolveConnectButton(lang string) []models.InlineKeyboardButton {
 
 	var inlineKeyboard []models.InlineKeyboardButton
@@ -261,10 +323,10 @@ func (h Handler) resolveConnectButton(lang string) []models.InlineKeyboardButton
 	return inlineKeyboard
 }
 
-func (h Handler) buildStartKeyboard(existingCustomer *database.Customer, langCode string) [][]models.InlineKeyboardButton {
+func (h Handler) buildStartKeyboard(existingCustomer *database.Customer, trialAvailable bool, langCode string) [][]models.InlineKeyboardButton {
 	var inlineKeyboard [][]models.InlineKeyboardButton
 
-	if existingCustomer.SubscriptionLink == nil && config.TrialDays() > 0 {
+	if trialAvailable {
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "trial_button"), CallbackData: CallbackTrial},
 		})
@@ -286,8 +348,16 @@ func (h Handler) buildStartKeyboard(existingCustomer *database.Customer, langCod
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "server_status_button"), URL: config.ServerStatusURL()},
 		})
+	} else {
+		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
+			{Text: h.translation.GetText(langCode, "server_status_button"), CallbackData: CallbackServerStatus},
+		})
 	}
 
+	inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "settings_button"), CallbackData: CallbackSettings},
+	})
+
 	if config.SupportURL() != "" {
 		inlineKeyboard = append(inlineKeyboard, []models.InlineKeyboardButton{
 			{Text: h.translation.GetText(langCode, "support_button"), URL: config.SupportURL()},
@@ -327,7 +397,7 @@ func (h Handler) TrialCallbackHandler(ctx context.Context, b *bot.Bot, update *m
 		slog.Error("customer not exist", "chatID", update.CallbackQuery.Message.Message.From.ID, "error", err)
 		return
 	}
-	if c.SubscriptionLink != nil {
+	if !h.isTrialAvailable(ctx, c) {
 		return
 	}
 	callback := update.CallbackQuery.Message.Message
@@ -362,13 +432,38 @@ func (h Handler) ActivateTrialCallbackHandler(ctx context.Context, b *bot.Bot, u
 		slog.Error("customer not exist", "chatID", update.CallbackQuery.Message.Message.From.ID, "error", err)
 		return
 	}
-	if c.SubscriptionLink != nil {
-		return
-	}
 	callback := update.CallbackQuery.Message.Message
-	ctxWithUsername := context.WithValue(ctx, "username", update.CallbackQuery.From.Username)
-	_, err = h.paymentService.ActivateTrial(ctxWithUsername, update.CallbackQuery.From.ID)
 	langCode := update.CallbackQuery.From.LanguageCode
+	if !h.isTrialAvailable(ctx, c) {
+		h.editTrialDenied(ctx, b, callback, langCode, "trial_already_used")
+		return
+	}
+	if reason := trialDeniedReason(&update.CallbackQuery.From); reason != "" {
+		h.editTrialDenied(ctx, b, callback, langCode, reason)
+		return
+	}
+	isMember, err := h.channelService.IsMember(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error checking channel membership", "telegramId", update.CallbackQuery.From.ID, "error", err)
+		return
+	}
+	if !isMember {
+		h.editChannelRequired(ctx, b, callback, langCode)
+		return
+	}
+	_, err = h.paymentService.ActivateTrial(ctx, update.CallbackQuery.From.ID)
+	if errors.Is(err, payment.ErrTrialAlreadyUsed) {
+		h.editTrialDenied(ctx, b, callback, langCode, "trial_already_used")
+		return
+	}
+	if errors.Is(err, remnawave.ErrUnavailable) {
+		h.answerServiceUnavailable(ctx, b, update.CallbackQuery.ID, langCode)
+		return
+	}
+	if err != nil {
+		slog.Error("Error activating trial", "telegramId", update.CallbackQuery.From.ID, "error", err)
+		return
+	}
 	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
 		ChatID:      callback.Chat.ID,
 		MessageID:   callback.ID,
@@ -381,6 +476,116 @@ func (h Handler) ActivateTrialCallbackHandler(ctx context.Context, b *bot.Bot, u
 	}
 }
 
+func (h Handler) isTrialAvailable(ctx context.Context, customer *database.Customer) bool {
+	if config.TrialDays() == 0 || customer.SubscriptionLink != nil || customer.TrialUsedAt != nil {
+		return false
+	}
+	used, err := h.trialRepository.IsUsed(ctx, customer.TelegramID)
+	if err != nil {
+		slog.Error("Error checking trial ledger", "telegramId", customer.TelegramID, "error", err)
+		return false
+	}
+	return !used
+}
+
+// trialDeniedReason applies the anti-abuse heuristics and returns the translation key
+// explaining the refusal, or an empty string if the user may activate the trial.
+func trialDeniedReason(user *models.User) string {
+	if config.TrialRequireUsername() && user.Username == "" {
+		return "trial_username_required"
+	}
+	// Telegram ids grow monotonically, so a high id means a recently registered account.
+	if config.TrialMaxTelegramId() > 0 && user.ID > config.TrialMaxTelegramId() {
+		return "trial_not_available"
+	}
+	return ""
+}
+
+func (h Handler) editTrialDenied(ctx context.Context, b *bot.Bot, callback *models.Message, langCode string, reason string) {
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		Text:      h.translation.GetText(langCode, reason),
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
+		}},
+	})
+	if err != nil {
+		slog.Error("Error sending trial denied message", "error", err)
+	}
+}
+
+func (h Handler) editChannelRequired(ctx context.Context, b *bot.Bot, callback *models.Message, langCode string) {
+	keyboard := h.channelService.SubscribeKeyboard(langCode, CallbackCheckChannel)
+	keyboard = append(keyboard, []models.InlineKeyboardButton{
+		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart},
+	})
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      callback.Chat.ID,
+		MessageID:   callback.ID,
+		Text:        h.translation.GetText(langCode, "channel_subscription_required"),
+		ParseMode:   models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	if err != nil {
+		slog.Error("Error sending channel subscription message", "error", err)
+	}
+}
+
+func (h Handler) CheckChannelCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if !h.answerIfNotChannelMember(ctx, b, update.CallbackQuery) {
+		h.ActivateTrialCallbackHandler(ctx, b, update)
+	}
+}
+
+func (h Handler) ClaimReferralBonusCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if h.answerIfNotChannelMember(ctx, b, update.CallbackQuery) {
+		return
+	}
+	langCode := update.CallbackQuery.From.LanguageCode
+	claimed, err := h.paymentService.ClaimReferralBonuses(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error claiming referral bonuses", "telegramId", update.CallbackQuery.From.ID, "error", err)
+		h.answerServiceUnavailable(ctx, b, update.CallbackQuery.ID, langCode)
+		return
+	}
+
+	text := h.translation.GetText(langCode, "referral_bonus_claimed")
+	if claimed == 0 {
+		text = h.translation.GetText(langCode, "referral_bonus_nothing_to_claim")
+	}
+	_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+		Text:            text,
+		ShowAlert:       claimed == 0,
+	})
+	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+}
+
+// answerIfNotChannelMember shows an alert and returns true if the user is still not subscribed.
+func (h Handler) answerIfNotChannelMember(ctx context.Context, b *bot.Bot, callbackQuery *models.CallbackQuery) bool {
+	isMember, err := h.channelService.IsMember(ctx, callbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error checking channel membership", "telegramId", callbackQuery.From.ID, "error", err)
+		return true
+	}
+	if isMember {
+		return false
+	}
+	_, err = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+		Text:            h.translation.GetText(callbackQuery.From.LanguageCode, "channel_not_subscribed"),
+		ShowAlert:       true,
+	})
+	if err != nil {
+		slog.Error("Error answering callback query", "error", err)
+	}
+	return true
+}
+
 func (h Handler) createConnectKeyboard(lang string) [][]models.InlineKeyboardButton {
 	var inlineCustomerKeyboard [][]models.InlineKeyboardButton
 	inlineCustomerKeyboard = append(inlineCustomerKeyboard, h.resolveConnectButton(lang))
@@ -394,34 +599,40 @@ func (h Handler) createConnectKeyboard(lang string) [][]models.InlineKeyboardBut
 func (h Handler) BuyCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	callback := update.CallbackQuery.Message.Message
 	langCode := update.CallbackQuery.From.LanguageCode
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return
+	}
+	discount := h.findActiveDiscount(ctx, customer)
 
 	var priceButtons []models.InlineKeyboardButton
 
 	if config.Price1() > 0 {
 		priceButtons = append(priceButtons, models.InlineKeyboardButton{
 			Text:         h.translation.GetText(langCode, "month_1"),
-			CallbackData: fmt.Sprintf("%s?month=%d&amount=%d", CallbackSell, 1, config.Price1()),
+			CallbackData: fmt.Sprintf("%s?month=%d", CallbackSell, 1),
 		})
 	}
 
 	if config.Price3() > 0 {
 		priceButtons = append(priceButtons, models.InlineKeyboardButton{
 			Text:         h.translation.GetText(langCode, "month_3"),
-			CallbackData: fmt.Sprintf("%s?month=%d&amount=%d", CallbackSell, 3, config.Price3()),
+			CallbackData: fmt.Sprintf("%s?month=%d", CallbackSell, 3),
 		})
 	}
 
 	if config.Price6() > 0 {
 		priceButtons = append(priceButtons, models.InlineKeyboardButton{
 			Text:         h.translation.GetText(langCode, "month_6"),
-			CallbackData: fmt.Sprintf("%s?month=%d&amount=%d", CallbackSell, 6, config.Price6()),
+			CallbackData: fmt.Sprintf("%s?month=%d", CallbackSell, 6),
 		})
 	}
 
 	if config.Price12() > 0 {
 		priceButtons = append(priceButtons, models.InlineKeyboardButton{
 			Text:         h.translation.GetText(langCode, "month_12"),
-			CallbackData: fmt.Sprintf("%s?month=%d&amount=%d", CallbackSell, 12, config.Price12()),
+			CallbackData: fmt.Sprintf("%s?month=%d", CallbackSell, 12),
 		})
 	}
 
@@ -438,44 +649,62 @@ func (h Handler) BuyCallbackHandler(ctx context.Context, b *bot.Bot, update *mod
 		{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart},
 	})
 
-	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+	text := h.translation.GetText(langCode, "pricing_info")
+	if discount != nil {
+		text += fmt.Sprintf(h.translation.GetText(langCode, "pricing_discount"), discount.DiscountPercent, discount.DiscountUntil.In(customer.Location()).Format("02.01.2006"))
+	}
+
+	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
 		ChatID:    callback.Chat.ID,
 		MessageID: callback.ID,
 		ParseMode: models.ParseModeHTML,
 		ReplyMarkup: models.InlineKeyboardMarkup{
 			InlineKeyboard: keyboard,
 		},
-		Text: h.translation.GetText(langCode, "pricing_info"),
+		Text: text,
 	})
 
 	if err != nil {
 		slog.Error("Error sending buy message", err)
 	}
 }
+
+// findActiveDiscount returns the personal win-back discount of the customer, or nil.
+func (h Handler) findActiveDiscount(ctx context.Context, customer *database.Customer) *database.CampaignDelivery {
+	if customer == nil {
+		return nil
+	}
+	discount, err := h.campaignRepository.FindActiveDiscount(ctx, customer.ID)
+	if err != nil {
+		slog.Error("Error finding campaign discount", "customerId", customer.ID, "error", err)
+		return nil
+	}
+	return discount
+}
+
 func (h Handler) SellCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	callback := update.CallbackQuery.Message.Message
 	callbackQuery := parseCallbackData(update.CallbackQuery.Data)
 	langCode := update.CallbackQuery.From.LanguageCode
 	month := callbackQuery["month"]
-	amount := callbackQuery["amount"]
 
 	var keyboard [][]models.InlineKeyboardButton
 
 	if config.IsCryptoPayEnabled() {
 		keyboard = append(keyboard, []models.InlineKeyboardButton{
-			{Text: h.translation.GetText(langCode, "crypto_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s&amount=%s", CallbackPayment, month, database.InvoiceTypeCrypto, amount)},
+			{Text: h.translation.GetText(langCode, "crypto_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s", CallbackPayment, month, database.InvoiceTypeCrypto)},
 		})
 	}
 
 	if config.IsYookasaEnabled() {
 		keyboard = append(keyboard, []models.InlineKeyboardButton{
-			{Text: h.translation.GetText(langCode, "card_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s&amount=%s", CallbackPayment, month, database.InvoiceTypeYookasa, amount)},
+			{Text: h.translation.GetText(langCode, "card_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s", CallbackPayment, month, database.InvoiceTypeYookasa)},
 		})
 	}
 
 	if config.IsTelegramStarsEnabled() {
 		keyboard = append(keyboard, []models.InlineKeyboardButton{
-			{Text: h.translation.GetText(langCode, "stars_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s&amount=%s", CallbackPayment, month, database.InvoiceTypeTelegram, amount)},
+			{Text: h.translation.GetText(langCode, "stars_button"), CallbackData: fmt.Sprintf("%s?month=%s&invoiceType=%s", CallbackPayment, month, database.InvoiceTypeTelegram)},
 		})
 	}
 
@@ -505,12 +734,6 @@ func (h Handler) PaymentCallbackHandler(ctx context.Context, b *bot.Bot, update
 		return
 	}
 
-	price, err := strconv.Atoi(callbackQuery["amount"])
-	if err != nil {
-		slog.Error("Error getting price from query", err)
-		return
-	}
-
 	invoiceType := database.InvoiceType(callbackQuery["invoiceType"])
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
@@ -525,8 +748,7 @@ func (h Handler) PaymentCallbackHandler(ctx context.Context, b *bot.Bot, update
 		return
 	}
 
-	ctxWithUsername := context.WithValue(ctx, "username", update.CallbackQuery.From.Username)
-	paymentURL, err := h.paymentService.CreatePurchase(ctxWithUsername, price, month, customer, invoiceType)
+	paymentURL, err := h.paymentService.CreatePurchase(ctx, month, customer, invoiceType)
 
 	if err != nil {
 		slog.Error("Error creating payment", err)
@@ -542,7 +764,7 @@ func (h Handler) PaymentCallbackHandler(ctx context.Context, b *bot.Bot, update
 			InlineKeyboard: [][]models.InlineKeyboardButton{
 				{
 					{Text: h.translation.GetText(langCode, "pay_button"), URL: paymentURL},
-					{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?month=%d&amount=%d", CallbackSell, month, price)},
+					{Text: h.translation.GetText(langCode, "back_button"), CallbackData: fmt.Sprintf("%s?month=%d", CallbackSell, month)},
 				},
 			},
 		},
@@ -569,15 +791,13 @@ func (h Handler) ConnectCommandHandler(ctx context.Context, b *bot.Bot, update *
 	isDisabled := true
 	_, err = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:    update.Message.Chat.ID,
-		Text:      buildConnectText(customer, langCode),
+		Text:      h.buildLiveConnectText(ctx, customer, langCode),
 		ParseMode: models.ParseModeHTML,
 		LinkPreviewOptions: &models.LinkPreviewOptions{
 			IsDisabled: &isDisabled,
 		},
 		ReplyMarkup: models.InlineKeyboardMarkup{
-			InlineKeyboard: [][]models.InlineKeyboardButton{
-				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
-			},
+			InlineKeyboard: h.connectScreenKeyboard(customer, langCode),
 		},
 	})
 
@@ -606,14 +826,12 @@ func (h Handler) ConnectCallbackHandler(ctx context.Context, b *bot.Bot, update
 		ChatID:    callback.Chat.ID,
 		MessageID: callback.ID,
 		ParseMode: models.ParseModeHTML,
-		Text:      buildConnectText(customer, langCode),
+		Text:      h.buildLiveConnectText(ctx, customer, langCode),
 		LinkPreviewOptions: &models.LinkPreviewOptions{
 			IsDisabled: &isDisabled,
 		},
 		ReplyMarkup: models.InlineKeyboardMarkup{
-			InlineKeyboard: [][]models.InlineKeyboardButton{
-				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
-			},
+			InlineKeyboard: h.connectScreenKeyboard(customer, langCode),
 		},
 	})
 
@@ -633,30 +851,40 @@ func (h Handler) PreCheckoutCallbackHandler(ctx context.Context, b *bot.Bot, upd
 }
 
 func (h Handler) SuccessPaymentHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	// invoices created before the profile was stored carry the username after "&"
 	payload := strings.Split(update.Message.SuccessfulPayment.InvoicePayload, "&")
 	purchaseId, err := strconv.Atoi(payload[0])
-	username := payload[1]
 	if err != nil {
 		slog.Error("Error parsing purchase id", err)
 		return
 	}
 
-	ctxWithUsername := context.WithValue(ctx, "username", username)
-	err = h.paymentService.ProcessPurchaseById(ctxWithUsername, int64(purchaseId))
+	err = h.paymentService.ProcessTelegramPayment(ctx, int64(purchaseId))
 	if err != nil {
 		slog.Error("Error processing purchase", err)
 	}
+	if errors.Is(err, remnawave.ErrUnavailable) {
+		_, err = b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:    update.Message.Chat.ID,
+			Text:      fmt.Sprintf(h.translation.GetText(update.Message.From.LanguageCode, "payment_activation_delayed"), purchaseId),
+			ParseMode: models.ParseModeHTML,
+		})
+		if err != nil {
+			slog.Error("Error sending payment delayed message", "error", err)
+		}
+	}
 
 }
 
-func (h Handler) SyncUsersCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	h.syncService.Sync()
-	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   "Users synced",
+// answerServiceUnavailable tells the user that the panel is unreachable instead of leaving the button spinning.
+func (h Handler) answerServiceUnavailable(ctx context.Context, b *bot.Bot, callbackQueryID string, langCode string) {
+	_, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQueryID,
+		Text:            h.translation.GetText(langCode, "service_unavailable"),
+		ShowAlert:       true,
 	})
 	if err != nil {
-		slog.Error("Error sending sync message", err)
+		slog.Error("Error answering callback query", "error", err)
 	}
 }
 
@@ -669,7 +897,7 @@ func buildConnectText(customer *database.Customer, langCode string) string {
 		currentTime := time.Now()
 
 		if currentTime.Before(*customer.ExpireAt) {
-			formattedDate := customer.ExpireAt.Format("02.01.2006 15:04")
+			formattedDate := customer.ExpireAt.In(customer.Location()).Format("02.01.2006 15:04")
 
 			subscriptionActiveText := tm.GetText(langCode, "subscription_active")
 			info.WriteString(fmt.Sprintf(subscriptionActiveText, formattedDate))
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"html"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/location"
+	"strings"
+	"time"
+)
+
+func (h Handler) ServerStatusCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    callback.Chat.ID,
+		MessageID: callback.ID,
+		ParseMode: models.ParseModeHTML,
+		Text:      h.buildServerStatusText(ctx, langCode),
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: h.translation.GetText(langCode, "refresh_button"), CallbackData: CallbackServerStatus}},
+				{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
+			},
+		},
+	})
+	if err != nil {
+		slog.Error("Error sending server status message", "error", err)
+	}
+}
+
+func (h Handler) buildServerStatusText(ctx context.Context, langCode string) string {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var text strings.Builder
+	text.WriteString(h.translation.GetText(langCode, "server_status_title"))
+
+	nodes, err := h.locationService.LiveNodes(ctxWithTimeout)
+	if err != nil {
+		slog.Error("Error getting nodes", "error", err)
+		text.WriteString(h.translation.GetText(langCode, "server_status_unavailable"))
+	} else if len(nodes) == 0 {
+		text.WriteString(h.translation.GetText(langCode, "locations_unavailable"))
+	}
+
+	for _, node := range nodes {
+		state := "🔴 " + h.translation.GetText(langCode, "server_status_offline")
+		if node.IsOnline() {
+			state = "🟢 " + h.translation.GetText(langCode, "server_status_online")
+		}
+
+		usersOnline := 0
+		if node.UsersOnline != nil {
+			usersOnline = *node.UsersOnline
+		}
+
+		load := h.translation.GetText(langCode, "server_status_no_data")
+		if node.TrafficUsedBytes != nil {
+			load = FormatBytes(*node.TrafficUsedBytes)
+			if node.TrafficLimitBytes != nil && *node.TrafficLimitBytes > 0 {
+				load = fmt.Sprintf("%s / %s\n%s", load, FormatBytes(*node.TrafficLimitBytes),
+					progressBar(*node.TrafficUsedBytes / *node.TrafficLimitBytes))
+			}
+		}
+
+		text.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "server_status_node"),
+			location.Flag(node.CountryCode), html.EscapeString(node.Name), state, usersOnline, load))
+	}
+
+	text.WriteString(fmt.Sprintf(h.translation.GetText(langCode, "server_status_updated"), time.Now().Format("02.01.2006 15:04:05")))
+	return text.String()
+}
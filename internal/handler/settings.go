@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/timezone"
+	"slices"
+	"time"
+)
+
+func (h Handler) SettingsCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return
+	}
+	if customer == nil {
+		slog.Error("customer not exist", "telegramId", update.CallbackQuery.From.ID)
+		return
+	}
+
+	h.showSettings(ctx, b, update, customer)
+}
+
+// SetTimezoneCallbackHandler stores the timezone chosen in the settings. An empty timezone
+// returns to the one inferred from the language.
+func (h Handler) SetTimezoneCallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	name := parseCallbackData(update.CallbackQuery.Data)["tz"]
+	if name != "" && !slices.Contains(timezone.Options(), name) {
+		slog.Warn("Unknown timezone option", "timezone", name)
+		return
+	}
+
+	customer, err := h.customerRepository.FindByTelegramId(ctx, update.CallbackQuery.From.ID)
+	if err != nil {
+		slog.Error("Error finding customer", "error", err)
+		return
+	}
+	if customer == nil {
+		slog.Error("customer not exist", "telegramId", update.CallbackQuery.From.ID)
+		return
+	}
+
+	customer.Timezone = nullableString(name)
+	if err := h.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{"timezone": customer.Timezone}); err != nil {
+		slog.Error("Error updating customer timezone", "error", err)
+		return
+	}
+
+	h.showSettings(ctx, b, update, customer)
+}
+
+func (h Handler) showSettings(ctx context.Context, b *bot.Bot, update *models.Update, customer *database.Customer) {
+	callback := update.CallbackQuery.Message.Message
+	langCode := update.CallbackQuery.From.LanguageCode
+
+	current := timezone.FromLanguage(customer.Language)
+	if customer.Timezone != nil {
+		current = *customer.Timezone
+	}
+	text := fmt.Sprintf(h.translation.GetText(langCode, "settings_text"),
+		timezone.Label(current), time.Now().In(customer.Location()).Format("15:04"))
+
+	var inlineKeyboard [][]models.InlineKeyboardButton
+	var row []models.InlineKeyboardButton
+	for _, name := range timezone.Options() {
+		label := timezone.Label(name)
+		if customer.Timezone != nil && *customer.Timezone == name {
+			label = "✅ " + label
+		}
+		row = append(row, models.InlineKeyboardButton{Text: label, CallbackData: fmt.Sprintf("%s?tz=%s", CallbackSetTimezone, name)})
+		if len(row) == 2 {
+			inlineKeyboard = append(inlineKeyboard, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		inlineKeyboard = append(inlineKeyboard, row)
+	}
+
+	autoLabel := h.translation.GetText(langCode, "timezone_auto_button")
+	if customer.Timezone == nil {
+		autoLabel = "✅ " + autoLabel
+	}
+	inlineKeyboard = append(inlineKeyboard,
+		[]models.InlineKeyboardButton{{Text: autoLabel, CallbackData: CallbackSetTimezone}},
+		[]models.InlineKeyboardButton{{Text: h.translation.GetText(langCode, "back_button"), CallbackData: CallbackStart}},
+	)
+
+	_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      callback.Chat.ID,
+		MessageID:   callback.ID,
+		ParseMode:   models.ParseModeHTML,
+		Text:        text,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: inlineKeyboard},
+	})
+	if err != nil {
+		slog.Error("Error sending settings message", "error", err)
+	}
+}
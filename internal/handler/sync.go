@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"html"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/sync"
+	"strings"
+	"time"
+)
+
+const syncReportMaxIds = 20
+
+// SyncUsersCommandHandler handles /sync, /sync dry and /sync status. The sync runs in the background,
+// so the update workers are not blocked, and the report is sent when it's done.
+func (h Handler) SyncUsersCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+	args := strings.Fields(update.Message.Text)
+
+	if len(args) > 1 && args[1] == "status" {
+		h.sendSyncMessage(ctx, b, chatID, h.buildSyncStatusText(ctx))
+		return
+	}
+
+	opts := sync.Options{
+		Trigger: database.SyncTriggerAdmin,
+		DryRun:  len(args) > 1 && args[1] == "dry",
+		Archive: true,
+	}
+
+	go func() {
+		ctx := context.Background()
+		var text string
+		report, err := h.syncService.Sync(ctx, opts)
+		switch {
+		case errors.Is(err, sync.ErrSyncInProgress):
+			text = "⏳ Sync is already running, try again later"
+		case err != nil:
+			slog.Error("Error syncing users", "error", err)
+			text = fmt.Sprintf("❌ Sync failed: %s", html.EscapeString(err.Error()))
+		default:
+			text = formatSyncReport(report)
+		}
+		h.sendSyncMessage(ctx, b, chatID, text)
+	}()
+}
+
+// RestoreUsersCommandHandler handles /restore and /restore dry, recreating the panel users of customers
+// with an active subscription that are missing in the panel.
+func (h Handler) RestoreUsersCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+	args := strings.Fields(update.Message.Text)
+	dryRun := len(args) > 1 && args[1] == "dry"
+
+	go func() {
+		ctx := context.Background()
+		var text string
+		report, err := h.syncService.Restore(ctx, dryRun)
+		switch {
+		case errors.Is(err, sync.ErrSyncInProgress):
+			text = "⏳ Sync is already running, try again later"
+		case err != nil:
+			slog.Error("Error restoring users", "error", err)
+			text = fmt.Sprintf("❌ Restore failed: %s", html.EscapeString(err.Error()))
+		default:
+			text = formatRestoreReport(report)
+		}
+		h.sendSyncMessage(ctx, b, chatID, text)
+	}()
+}
+
+func (h Handler) sendSyncMessage(ctx context.Context, b *bot.Bot, chatID int64, text string) {
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    chatID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+	})
+	if err != nil {
+		slog.Error("Error sending sync message", "error", err)
+	}
+}
+
+func (h Handler) buildSyncStatusText(ctx context.Context) string {
+	run, err := h.syncService.LastRun(ctx)
+	if err != nil {
+		slog.Error("Error getting last sync run", "error", err)
+		return "❌ Failed to get the last sync"
+	}
+	if run == nil {
+		return "No sync has been run yet"
+	}
+
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("🕒 <b>Last sync</b> (%s): %s, took %s\n\n",
+		run.Trigger, run.FinishedAt.Format("02.01.2006 15:04:05"), run.FinishedAt.Sub(run.StartedAt).Round(time.Second)))
+	text.WriteString(fmt.Sprintf("Panel users: %d\nCreated: %d\nUpdated: %d\nRestored: %d\nArchived: %d\n",
+		run.PanelUsers, run.Created, run.Updated, run.Restored, run.Archived))
+	if run.Error != nil {
+		text.WriteString(fmt.Sprintf("\n❌ Error: %s", html.EscapeString(*run.Error)))
+	}
+	return text.String()
+}
+
+func formatSyncReport(report *sync.Report) string {
+	var text strings.Builder
+	if report.DryRun {
+		text.WriteString("🔍 <b>Sync dry run</b>, nothing was changed\n\n")
+	} else {
+		text.WriteString("✅ <b>Users synced</b>\n\n")
+	}
+	text.WriteString(fmt.Sprintf("Panel users: %d\n", report.PanelUsers))
+
+	writeSyncSection(&text, "Created", report.Created, report.DryRun)
+	writeSyncSection(&text, "Updated", report.Updated, report.DryRun)
+	writeSyncSection(&text, "Restored", report.Restored, report.DryRun)
+	writeSyncSection(&text, "Archived", report.Archived, report.DryRun)
+
+	if report.ArchiveSkipped {
+		text.WriteString(fmt.Sprintf("\n⚠️ %d of %d customers are missing in the panel. Archiving is skipped, check the panel and run /sync dry",
+			len(report.Archived), report.ActiveCustomers))
+	}
+	return text.String()
+}
+
+func formatRestoreReport(report *sync.RestoreReport) string {
+	var text strings.Builder
+	if report.DryRun {
+		text.WriteString("🔍 <b>Restore dry run</b>, nothing was changed\n\n")
+	} else {
+		text.WriteString("♻️ <b>Users restored</b>\n\n")
+	}
+	text.WriteString(fmt.Sprintf("Active subscriptions checked: %d\n", report.Checked))
+
+	title := "Restored"
+	if report.DryRun {
+		title = "Missing in panel"
+	}
+	writeSyncSection(&text, title, report.Restored, true)
+	writeSyncSection(&text, "Failed", report.Failed, true)
+	return text.String()
+}
+
+func writeSyncSection(text *strings.Builder, title string, telegramIDs []int64, withIds bool) {
+	text.WriteString(fmt.Sprintf("%s: %d\n", title, len(telegramIDs)))
+	if !withIds || len(telegramIDs) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, syncReportMaxIds)
+	for i, id := range telegramIDs {
+		if i == syncReportMaxIds {
+			ids = append(ids, fmt.Sprintf("… +%d", len(telegramIDs)-syncReportMaxIds))
+			break
+		}
+		ids = append(ids, fmt.Sprintf("<code>%d</code>", id))
+	}
+	text.WriteString(strings.Join(ids, ", ") + "\n")
+}
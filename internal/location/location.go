@@ -0,0 +1,153 @@
+package location
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheTTL    = 5 * time.Minute
+	placeholder = "{{locations}}"
+)
+
+type Service struct {
+	panels      *remnawave.Panels
+	translation *translation.Manager
+
+	mu        sync.Mutex
+	nodes     []remnawave.Node
+	fetchedAt time.Time
+}
+
+func NewService(panels *remnawave.Panels, translation *translation.Manager) *Service {
+	return &Service{panels: panels, translation: translation}
+}
+
+// Nodes returns the panel nodes of the allowed countries, none if no node passes the filter.
+// The list is cached for cacheTTL, and the stale copy is served if the panel can't be reached.
+func (s *Service) Nodes(ctx context.Context) []remnawave.Node {
+	s.mu.Lock()
+	fresh := s.nodes != nil && time.Since(s.fetchedAt) < cacheTTL
+	nodes := s.nodes
+	s.mu.Unlock()
+	if fresh {
+		return nodes
+	}
+
+	nodes, err := s.LiveNodes(ctx)
+	if err != nil {
+		slog.Error("Error getting nodes", "error", err)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.nodes
+	}
+	return nodes
+}
+
+// LiveNodes fetches the nodes from the panel bypassing the cache and stores the result in it.
+func (s *Service) LiveNodes(ctx context.Context) ([]remnawave.Node, error) {
+	nodes, err := s.panels.GetNodes(ctx)
+	if err != nil && len(nodes) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		slog.Warn("Error getting nodes of some panels", "error", err)
+	}
+
+	filtered := make([]remnawave.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if isCountryAllowed(node.CountryCode) {
+			filtered = append(filtered, node)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = filtered
+	s.fetchedAt = time.Now()
+	return filtered, nil
+}
+
+// Greeting returns the greeting text with the {{locations}} placeholder replaced by the list of locations.
+func (s *Service) Greeting(ctx context.Context, langCode string) string {
+	greeting := s.translation.GetText(langCode, "greeting")
+	if !strings.Contains(greeting, placeholder) {
+		return greeting
+	}
+	return strings.ReplaceAll(greeting, placeholder, s.render(ctx, langCode))
+}
+
+func (s *Service) render(ctx context.Context, langCode string) string {
+	online := make(map[string]bool)
+	var countries []string
+	for _, node := range s.Nodes(ctx) {
+		code := strings.ToUpper(node.CountryCode)
+		if _, exists := online[code]; !exists {
+			countries = append(countries, code)
+		}
+		online[code] = online[code] || node.IsOnline()
+	}
+
+	if len(countries) == 0 {
+		return s.translation.GetText(langCode, "locations_unavailable")
+	}
+
+	sort.Strings(countries)
+	lines := make([]string, 0, len(countries))
+	for _, code := range countries {
+		state := "🔴"
+		if online[code] {
+			state = "🟢"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", Flag(code), CountryName(code, langCode), state))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isCountryAllowed(countryCode string) bool {
+	allowed := config.AllowedCountries()
+	if len(allowed) == 0 {
+		return true
+	}
+	return allowed[strings.ToUpper(countryCode)]
+}
+
+// Flag converts an ISO 3166-1 alpha-2 code to the flag emoji.
+func Flag(countryCode string) string {
+	if len(countryCode) != 2 {
+		return "🌐"
+	}
+	var flag strings.Builder
+	for _, r := range strings.ToUpper(countryCode) {
+		if r < 'A' || r > 'Z' {
+			return "🌐"
+		}
+		flag.WriteRune(r - 'A' + 0x1F1E6)
+	}
+	return flag.String()
+}
+
+func CountryName(countryCode string, langCode string) string {
+	region, err := language.ParseRegion(countryCode)
+	if err != nil {
+		return countryCode
+	}
+	tag, err := language.Parse(langCode)
+	if err != nil {
+		tag = language.English
+	}
+	if name := display.Regions(tag).Name(region); name != "" {
+		return name
+	}
+	return countryCode
+}
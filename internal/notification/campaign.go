@@ -0,0 +1,119 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/handler"
+	"remnawave-tg-shop-bot/internal/translation"
+	"time"
+)
+
+// campaignLookback is how long after the campaign day a customer is still targeted, so a run missed
+// while the bot was down is caught up on the next one.
+const campaignLookback = 3 * 24 * time.Hour
+
+type CampaignService struct {
+	customerRepository *database.CustomerRepository
+	campaignRepository *database.CampaignRepository
+	telegramBot        *bot.Bot
+	tm                 *translation.Manager
+}
+
+func NewCampaignService(customerRepository *database.CustomerRepository, campaignRepository *database.CampaignRepository, telegramBot *bot.Bot, tm *translation.Manager) *CampaignService {
+	return &CampaignService{customerRepository: customerRepository, campaignRepository: campaignRepository, telegramBot: telegramBot, tm: tm}
+}
+
+// RunCampaigns sends every configured win-back campaign to the customers of its segment. A campaign reaches
+// a customer once per expired subscription, within NOTIFICATION_HOURS of the customer's timezone.
+func (s *CampaignService) RunCampaigns(ctx context.Context) error {
+	var errs []error
+	for _, campaign := range config.Campaigns() {
+		if err := s.runCampaign(ctx, campaign); err != nil {
+			errs = append(errs, fmt.Errorf("campaign %s: %w", campaign.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *CampaignService) runCampaign(ctx context.Context, campaign config.CampaignConfig) error {
+	to := time.Now().AddDate(0, 0, -campaign.Days)
+	customers, err := s.customerRepository.FindExpiredBetween(ctx, to.Add(-campaignLookback), to,
+		campaign.Segment == config.SegmentTrialNeverPaid)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sent := 0
+	for _, customer := range customers {
+		if !inDaytime(now, customer) {
+			continue
+		}
+		delivery := &database.CampaignDelivery{
+			Campaign:   campaign.Name,
+			CustomerID: customer.ID,
+			Period:     *customer.ExpireAt,
+		}
+		if campaign.Discount > 0 {
+			discountUntil := time.Now().AddDate(0, 0, campaign.DiscountDays)
+			delivery.DiscountPercent = campaign.Discount
+			delivery.DiscountUntil = &discountUntil
+		}
+
+		claimed, err := s.campaignRepository.Claim(ctx, delivery)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := s.send(ctx, campaign, customer, delivery); err != nil {
+			slog.Error("Failed to send campaign message", "campaign", campaign.Name, "customer_id", customer.ID, "error", err)
+			if !isTransientSendError(err) {
+				continue
+			}
+			if releaseErr := s.campaignRepository.Release(ctx, delivery.ID); releaseErr != nil {
+				slog.Error("Failed to release campaign delivery", "campaign", campaign.Name, "customer_id", customer.ID, "error", releaseErr)
+			}
+			continue
+		}
+		sent++
+	}
+
+	slog.Info("Campaign completed", "campaign", campaign.Name, "sent", sent)
+	return nil
+}
+
+// send renders winback_<campaign> or, if the campaign has no own message, winback_<segment>.
+func (s *CampaignService) send(ctx context.Context, campaign config.CampaignConfig, customer database.Customer, delivery *database.CampaignDelivery) error {
+	key := "winback_" + campaign.Name
+	if !s.tm.HasText(key) {
+		key = "winback_" + campaign.Segment
+	}
+
+	location := customer.Location()
+	text := fmt.Sprintf(s.tm.GetText(customer.Language, key), customer.ExpireAt.In(location).Format("02.01.2006"))
+	if delivery.DiscountUntil != nil {
+		text += fmt.Sprintf(s.tm.GetText(customer.Language, "winback_discount"),
+			delivery.DiscountPercent, delivery.DiscountUntil.In(location).Format("02.01.2006"))
+	}
+
+	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    customer.TelegramID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: s.tm.GetText(customer.Language, "renew_subscription_button"), CallbackData: handler.CallbackBuy}},
+			},
+		},
+	})
+	return err
+}
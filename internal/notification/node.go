@@ -0,0 +1,86 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"html"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"sync"
+)
+
+type NodeMonitor struct {
+	panels      *remnawave.Panels
+	telegramBot *bot.Bot
+
+	mu     sync.Mutex
+	states map[string]bool
+}
+
+func NewNodeMonitor(panels *remnawave.Panels, telegramBot *bot.Bot) *NodeMonitor {
+	return &NodeMonitor{panels: panels, telegramBot: telegramBot}
+}
+
+// CheckNodes compares the node states with the previous check and alerts the admin about the changes.
+// The first check only records the states.
+func (m *NodeMonitor) CheckNodes(ctx context.Context) error {
+	nodes, err := m.panels.GetNodes(ctx)
+	if err != nil {
+		if len(nodes) == 0 {
+			return fmt.Errorf("failed to get nodes: %w", err)
+		}
+		slog.Error("Error getting nodes of some panels", "error", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		online := node.IsOnline()
+		states[node.UUID] = online
+
+		if m.states == nil {
+			continue
+		}
+		wasOnline, known := m.states[node.UUID]
+		if !known || wasOnline == online {
+			continue
+		}
+
+		if err := m.sendAlert(ctx, node); err != nil {
+			slog.Error("Failed to send node alert", "node", node.Name, "error", err)
+			continue
+		}
+		slog.Info("Node alert sent", "node", node.Name, "online", online)
+	}
+	if err != nil {
+		// keep the states of the nodes of unreachable panels, so their changes are still noticed
+		for uuid, online := range m.states {
+			if _, ok := states[uuid]; !ok {
+				states[uuid] = online
+			}
+		}
+	}
+	m.states = states
+
+	return nil
+}
+
+func (m *NodeMonitor) sendAlert(ctx context.Context, node remnawave.Node) error {
+	name, address := html.EscapeString(node.Name), html.EscapeString(node.Address)
+	text := fmt.Sprintf("🔴 Node <b>%s</b> (%s) is offline", name, address)
+	if node.IsOnline() {
+		text = fmt.Sprintf("🟢 Node <b>%s</b> (%s) is back online", name, address)
+	}
+
+	_, err := m.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    config.GetAdminTelegramId(),
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+	})
+	return err
+}
@@ -0,0 +1,92 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/timezone"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ReportService struct {
+	reportRepository *database.ReportRepository
+	telegramBot      *bot.Bot
+}
+
+func NewReportService(reportRepository *database.ReportRepository, telegramBot *bot.Bot) *ReportService {
+	return &ReportService{reportRepository: reportRepository, telegramBot: telegramBot}
+}
+
+// SendDailyReport sends the admin the summary of the previous day. Days start at midnight of DEFAULT_TIMEZONE.
+func (s *ReportService) SendDailyReport(ctx context.Context) error {
+	today := startOfDay(time.Now())
+	from := today.AddDate(0, 0, -1)
+	return s.send(ctx, fmt.Sprintf("📊 <b>Daily report</b> · %s", from.Format("02.01.2006")), from, today)
+}
+
+// SendWeeklyReport sends the admin the summary of the previous week, from Monday to Sunday.
+func (s *ReportService) SendWeeklyReport(ctx context.Context) error {
+	today := startOfDay(time.Now())
+	to := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	from := to.AddDate(0, 0, -7)
+	title := fmt.Sprintf("📊 <b>Weekly report</b> · %s – %s", from.Format("02.01.2006"), to.AddDate(0, 0, -1).Format("02.01.2006"))
+	return s.send(ctx, title, from, to)
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.In(timezone.Load(config.DefaultTimezone()))
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func (s *ReportService) send(ctx context.Context, title string, from, to time.Time) error {
+	report, err := s.reportRepository.Build(ctx, from, to, config.TrialDays())
+	if err != nil {
+		return fmt.Errorf("failed to build report: %w", err)
+	}
+
+	_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    config.GetAdminTelegramId(),
+		Text:      title + "\n\n" + formatReport(report),
+		ParseMode: models.ParseModeHTML,
+	})
+	return err
+}
+
+func formatReport(report *database.Report) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "👤 New users: <b>%d</b>, by referral: %d\n", report.NewUsers, report.Referrals)
+	if config.TrialDays() > 0 {
+		fmt.Fprintf(&sb, "🎁 Trials started: <b>%d</b>\n", report.TrialsStarted)
+		fmt.Fprintf(&sb, "🔄 Trial → paid: <b>%d</b> of %d ended trials (%s)\n",
+			report.TrialsConverted, report.TrialsEnded, percent(report.TrialsConverted, report.TrialsEnded))
+	}
+	fmt.Fprintf(&sb, "🛒 Purchases: <b>%d</b>, first: %d, renewals: %d\n",
+		report.FirstPurchases+report.Renewals, report.FirstPurchases, report.Renewals)
+
+	sb.WriteString("💰 Revenue:")
+	if len(report.Revenue) == 0 {
+		sb.WriteString(" none")
+	}
+	for _, revenue := range report.Revenue {
+		fmt.Fprintf(&sb, "\n  • %s: <b>%s %s</b> (%d)", revenue.InvoiceType,
+			strconv.FormatFloat(revenue.Amount, 'f', -1, 64), revenue.Currency, revenue.Purchases)
+	}
+	sb.WriteString("\n\n")
+
+	fmt.Fprintf(&sb, "✅ Active subscriptions: <b>%d</b>, paid: %d\n", report.ActiveSubscriptions, report.ActivePaid)
+	fmt.Fprintf(&sb, "📉 Churn: <b>%d</b> paid subscriptions expired without renewal, %d trials expired",
+		report.Churned, report.ExpiredTrials)
+	return sb.String()
+}
+
+func percent(part, total int) string {
+	if total == 0 {
+		return "—"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
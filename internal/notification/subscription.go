@@ -2,10 +2,12 @@ package notification
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/handler"
 	"remnawave-tg-shop-bot/internal/translation"
@@ -13,17 +15,27 @@ import (
 )
 
 type SubscriptionService struct {
-	customerRepository *database.CustomerRepository
-	telegramBot        *bot.Bot
-	tm                 *translation.Manager
+	customerRepository        *database.CustomerRepository
+	notificationLogRepository *database.NotificationLogRepository
+	telegramBot               *bot.Bot
+	tm                        *translation.Manager
 }
 
-func NewSubscriptionService(customerRepository *database.CustomerRepository, telegramBot *bot.Bot, tm *translation.Manager) *SubscriptionService {
-	return &SubscriptionService{customerRepository: customerRepository, telegramBot: telegramBot, tm: tm}
+func NewSubscriptionService(customerRepository *database.CustomerRepository, notificationLogRepository *database.NotificationLogRepository, telegramBot *bot.Bot, tm *translation.Manager) *SubscriptionService {
+	return &SubscriptionService{customerRepository: customerRepository, notificationLogRepository: notificationLogRepository, telegramBot: telegramBot, tm: tm}
 }
 
+// SendSubscriptionNotifications sends every customer whose subscription is within NOTIFICATION_STAGES the reminder
+// of the current stage. A stage is sent once per subscription period, and a stage missed while the bot was down
+// is replaced by the next one instead of sending both. The days are counted in the customer's timezone and the
+// reminders are sent only within NOTIFICATION_HOURS of it, so the check runs every hour.
 func (s *SubscriptionService) SendSubscriptionNotifications(ctx context.Context) error {
-	customers, err := s.getCustomersWithExpiringSubscriptions()
+	stages := config.NotificationStages()
+	if len(stages) == 0 {
+		return nil
+	}
+
+	customers, err := s.getCustomersWithinStages(ctx, stages)
 	if err != nil {
 		return fmt.Errorf("failed to get customers with expiring subscriptions: %w", err)
 	}
@@ -32,36 +44,112 @@ func (s *SubscriptionService) SendSubscriptionNotifications(ctx context.Context)
 
 	now := time.Now()
 	for _, customer := range *customers {
+		if !inDaytime(now, customer) {
+			continue
+		}
+		location := customer.Location()
+		daysUntilExpiration := s.getDaysUntilExpiration(now.In(location), customer.ExpireAt.In(location))
+		if daysUntilExpiration <= 0 && customer.ExpireAt.After(now) {
+			// the "expired" stages wait until the subscription actually expires
+			continue
+		}
+		stage, ok := currentStage(stages, daysUntilExpiration)
+		if !ok {
+			continue
+		}
 
-		daysUntilExpiration := s.getDaysUntilExpiration(now, *customer.ExpireAt)
-
-		err := s.sendNotification(ctx, customer)
+		sent, err := s.sendStage(ctx, customer, stage)
 		if err != nil {
 			slog.Error("Failed to send notification",
 				"customer_id", customer.ID,
 				"days_until_expiration", daysUntilExpiration,
+				"stage", stage,
 				"error", err)
 			continue
 		}
+		if !sent {
+			continue
+		}
 
 		slog.Info("Notification sent successfully",
 			"customer_id", customer.ID,
-			"days_until_expiration", daysUntilExpiration)
+			"days_until_expiration", daysUntilExpiration,
+			"stage", stage)
 	}
 
 	return nil
 }
 
-func (s *SubscriptionService) getCustomersWithExpiringSubscriptions() (*[]database.Customer, error) {
+func (s *SubscriptionService) getCustomersWithinStages(ctx context.Context, stages []int) (*[]database.Customer, error) {
+	// one more day on both sides covers the customers in other timezones, their stage is checked in local time
 	now := time.Now()
-	endDate := now.AddDate(0, 0, 3)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	startDate := today.AddDate(0, 0, stages[len(stages)-1]-1)
+	endDate := today.AddDate(0, 0, stages[0]+2)
+
+	return s.customerRepository.FindByExpirationRange(ctx, startDate, endDate)
+}
 
-	dbCustomers, err := s.customerRepository.FindByExpirationRange(context.Background(), now, endDate)
+// currentStage returns the latest stage the customer has reached. The stages are sorted from the earliest one.
+func currentStage(stages []int, daysUntilExpiration int) (int, bool) {
+	stage, ok := 0, false
+	for _, s := range stages {
+		if s < daysUntilExpiration {
+			break
+		}
+		stage, ok = s, true
+	}
+	return stage, ok
+}
+
+// stageKey returns the translation key of the stage, which is also the notification type in the log.
+func stageKey(stage int) string {
+	switch {
+	case stage > 0:
+		return fmt.Sprintf("subscription_expiring_%dd", stage)
+	case stage == 0:
+		return "subscription_expired_today"
+	default:
+		return fmt.Sprintf("subscription_expired_%dd_ago", -stage)
+	}
+}
+
+// sendStage sends the stage reminder unless it was already sent for the current subscription period.
+func (s *SubscriptionService) sendStage(ctx context.Context, customer database.Customer, stage int) (bool, error) {
+	key := stageKey(stage)
+	claimed, err := s.notificationLogRepository.Claim(ctx, customer.ID, key, *customer.ExpireAt)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	if !s.tm.HasText(key) {
+		key = "subscription_expiring"
+		if stage <= 0 {
+			key = "subscription_expired"
+		}
 	}
 
-	return dbCustomers, nil
+	if err := s.sendNotification(ctx, customer, key); err != nil {
+		if !isTransientSendError(err) {
+			return false, err
+		}
+		if releaseErr := s.notificationLogRepository.Release(ctx, customer.ID, stageKey(stage), *customer.ExpireAt); releaseErr != nil {
+			slog.Error("Failed to release notification", "customer_id", customer.ID, "error", releaseErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isTransientSendError reports whether a failed send is worth retrying on the next run. Telegram answers 403 when
+// the customer blocked the bot and 400 when the chat is gone, so those keep the claim; rate limits, server and
+// network errors release it.
+func isTransientSendError(err error) bool {
+	var migrateErr *bot.MigrateError
+	return !errors.Is(err, bot.ErrorForbidden) && !errors.Is(err, bot.ErrorBadRequest) && !errors.As(err, &migrateErr)
 }
 
 func (s *SubscriptionService) getDaysUntilExpiration(now time.Time, expireAt time.Time) int {
@@ -72,12 +160,12 @@ func (s *SubscriptionService) getDaysUntilExpiration(now time.Time, expireAt tim
 	return int(duration.Hours() / 24)
 }
 
-func (s *SubscriptionService) sendNotification(ctx context.Context, customer database.Customer) error {
-	expireDate := customer.ExpireAt.Format("02.01.2006")
+func (s *SubscriptionService) sendNotification(ctx context.Context, customer database.Customer, key string) error {
+	expireDate := customer.ExpireAt.In(customer.Location()).Format("02.01.2006")
 
 	messageText := fmt.Sprintf(
-		s.tm.GetText(customer.Language, "subscription_expiring"),
-		bot.EscapeMarkdown(expireDate),
+		s.tm.GetText(customer.Language, key),
+		expireDate,
 	)
 
 	_, err := s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
@@ -98,3 +186,10 @@ func (s *SubscriptionService) sendNotification(ctx context.Context, customer dat
 
 	return err
 }
+
+// inDaytime reports whether it is within NOTIFICATION_HOURS in the customer's timezone.
+func inDaytime(now time.Time, customer database.Customer) bool {
+	start, end := config.NotificationHours()
+	hour := now.In(customer.Location()).Hour()
+	return hour >= start && hour < end
+}
@@ -0,0 +1,158 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/handler"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"remnawave-tg-shop-bot/internal/translation"
+	"time"
+)
+
+type TrafficMonitor struct {
+	panels                    *remnawave.Panels
+	customerRepository        *database.CustomerRepository
+	notificationLogRepository *database.NotificationLogRepository
+	telegramBot               *bot.Bot
+	tm                        *translation.Manager
+}
+
+func NewTrafficMonitor(panels *remnawave.Panels, customerRepository *database.CustomerRepository, notificationLogRepository *database.NotificationLogRepository, telegramBot *bot.Bot, tm *translation.Manager) *TrafficMonitor {
+	return &TrafficMonitor{
+		panels: panels, customerRepository: customerRepository, notificationLogRepository: notificationLogRepository, telegramBot: telegramBot, tm: tm,
+	}
+}
+
+// CheckTraffic warns the users whose traffic usage reached a threshold of TRAFFIC_THRESHOLDS. Each threshold
+// is sent once per traffic period, which starts at the last traffic reset of the panel user.
+func (m *TrafficMonitor) CheckTraffic(ctx context.Context) error {
+	thresholds := config.TrafficThresholds()
+	if len(thresholds) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, panelID := range m.panels.Names() {
+		err := m.panels.Get(&panelID).ForEachUsersPage(ctx, func(users []remapi.UserDto) error {
+			return m.checkPage(ctx, users, thresholds)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("panel %s: %w", panelID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *TrafficMonitor) checkPage(ctx context.Context, users []remapi.UserDto, thresholds []int) error {
+	usersByTelegramID := make(map[int64][]remapi.UserDto)
+	var telegramIDs []int64
+	for _, user := range users {
+		if user.TelegramId.Null || user.Status.Or(remapi.UserDtoStatusACTIVE) != remapi.UserDtoStatusACTIVE {
+			continue
+		}
+		if _, ok := reachedThreshold(thresholds, user); !ok {
+			continue
+		}
+		telegramID := int64(user.TelegramId.Value)
+		if _, ok := usersByTelegramID[telegramID]; !ok {
+			telegramIDs = append(telegramIDs, telegramID)
+		}
+		usersByTelegramID[telegramID] = append(usersByTelegramID[telegramID], user)
+	}
+	if len(telegramIDs) == 0 {
+		return nil
+	}
+
+	customers, err := m.customerRepository.FindByTelegramIds(ctx, telegramIDs)
+	if err != nil {
+		return fmt.Errorf("failed to find customers by telegram ids: %w", err)
+	}
+
+	now := time.Now()
+	for _, customer := range customers {
+		// a warning outside of the customer's daytime is sent by the first check within it
+		if customer.ArchivedAt != nil || !inDaytime(now, customer) {
+			continue
+		}
+		for _, user := range usersByTelegramID[customer.TelegramID] {
+			// the warning is about the user the customer is bound to, not about its duplicates
+			if customer.RemnawaveUUID != nil && *customer.RemnawaveUUID != user.UUID {
+				continue
+			}
+			threshold, _ := reachedThreshold(thresholds, user)
+			sent, err := m.warn(ctx, customer, user, threshold)
+			if err != nil {
+				slog.Error("Failed to send traffic warning", "customer_id", customer.ID, "threshold", threshold, "error", err)
+			} else if sent {
+				slog.Info("Traffic warning sent", "customer_id", customer.ID, "threshold", threshold)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// reachedThreshold returns the highest threshold reached by the user. The thresholds are sorted from the highest.
+func reachedThreshold(thresholds []int, user remapi.UserDto) (int, bool) {
+	limit := user.TrafficLimitBytes.Or(0)
+	if limit <= 0 {
+		return 0, false
+	}
+	percent := user.UsedTrafficBytes * 100 / float64(limit)
+	for _, threshold := range thresholds {
+		if percent >= float64(threshold) {
+			return threshold, true
+		}
+	}
+	return 0, false
+}
+
+func (m *TrafficMonitor) warn(ctx context.Context, customer database.Customer, user remapi.UserDto, threshold int) (bool, error) {
+	period := user.CreatedAt
+	if resetAt, ok := user.LastTrafficResetAt.Get(); ok {
+		period = resetAt
+	}
+
+	notificationType := fmt.Sprintf("traffic_%d", threshold)
+	claimed, err := m.notificationLogRepository.Claim(ctx, customer.ID, notificationType, period)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	text := fmt.Sprintf(m.tm.GetText(customer.Language, "traffic_threshold"), threshold,
+		handler.FormatBytes(user.UsedTrafficBytes), handler.FormatBytes(float64(user.TrafficLimitBytes.Or(0))))
+	if config.ResetTrafficOnRenewal() {
+		text += m.tm.GetText(customer.Language, "traffic_threshold_renew")
+	}
+
+	_, err = m.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:    customer.TelegramID,
+		Text:      text,
+		ParseMode: models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: m.tm.GetText(customer.Language, "renew_subscription_button"), CallbackData: handler.CallbackBuy}},
+			},
+		},
+	})
+	if err != nil {
+		if !isTransientSendError(err) {
+			return false, err
+		}
+		if releaseErr := m.notificationLogRepository.Release(ctx, customer.ID, notificationType, period); releaseErr != nil {
+			slog.Error("Failed to release notification", "customer_id", customer.ID, "error", releaseErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -2,49 +2,74 @@ package payment
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	"log/slog"
+	"remnawave-tg-shop-bot/internal/alert"
+	"remnawave-tg-shop-bot/internal/channel"
 	"remnawave-tg-shop-bot/internal/config"
 	"remnawave-tg-shop-bot/internal/cryptopay"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/remnawave"
 	"remnawave-tg-shop-bot/internal/translation"
 	"remnawave-tg-shop-bot/internal/yookasa"
+	"strconv"
 	"time"
 )
 
 type PaymentService struct {
 	purchaseRepository *database.PurchaseRepository
-	remnawaveClient    *remnawave.Client
+	panels             *remnawave.Panels
 	customerRepository *database.CustomerRepository
 	telegramBot        *bot.Bot
 	translation        *translation.Manager
 	cryptoPayClient    *cryptopay.Client
 	yookasaClient      *yookasa.Client
 	referralRepository *database.ReferralRepository
+	trialRepository    *database.TrialRepository
+	channelService     *channel.Service
+	campaignRepository *database.CampaignRepository
 }
 
+// campaignAttributionWindow is how long after a win-back message a purchase counts as its conversion.
+const campaignAttributionWindow = 30 * 24 * time.Hour
+
+// CallbackClaimReferral is the data of the button that claims the referral bonuses held back until the
+// referrer subscribes to the channel.
+const CallbackClaimReferral = "claim_referral_bonus"
+
+var (
+	ErrTrialAlreadyUsed = errors.New("trial already used")
+	ErrLinkResetTooSoon = errors.New("subscription link was reset recently")
+)
+
 func NewPaymentService(
 	translation *translation.Manager,
 	purchaseRepository *database.PurchaseRepository,
-	remnawaveClient *remnawave.Client,
+	panels *remnawave.Panels,
 	customerRepository *database.CustomerRepository,
 	telegramBot *bot.Bot,
 	cryptoPayClient *cryptopay.Client,
 	yookasaClient *yookasa.Client,
 	referralRepository *database.ReferralRepository,
+	trialRepository *database.TrialRepository,
+	channelService *channel.Service,
+	campaignRepository *database.CampaignRepository,
 ) *PaymentService {
 	return &PaymentService{
 		purchaseRepository: purchaseRepository,
-		remnawaveClient:    remnawaveClient,
+		panels:             panels,
 		customerRepository: customerRepository,
 		telegramBot:        telegramBot,
 		translation:        translation,
 		cryptoPayClient:    cryptoPayClient,
 		yookasaClient:      yookasaClient,
 		referralRepository: referralRepository,
+		trialRepository:    trialRepository,
+		channelService:     channelService,
+		campaignRepository: campaignRepository,
 	}
 }
 
@@ -65,26 +90,55 @@ func (s PaymentService) ProcessPurchaseById(ctx context.Context, purchaseId int6
 		return fmt.Errorf("customer %s not found", purchase.CustomerID)
 	}
 
-	user, err := s.remnawaveClient.CreateOrUpdateUser(ctx, customer.ID, customer.TelegramID, config.TrafficLimit(), purchase.Month*30)
+	// the invoice checkers and the Stars retry can reach the same purchase concurrently
+	claimed, err := s.purchaseRepository.ClaimForProcessing(ctx, purchase.ID)
 	if err != nil {
 		return err
 	}
+	if !claimed {
+		slog.Info("Purchase is already processed", "purchaseId", purchase.ID, "status", purchase.Status)
+		return nil
+	}
+
+	panelID, panelClient := s.panelFor(ctx, customer, strconv.Itoa(purchase.Month))
+	user, err := panelClient.CreateOrUpdateUser(ctx, customer.ID, customer.TelegramID, customer.RemnawaveUUID, customer.Profile(), config.TrafficLimit(), purchase.Month*30, config.TrafficLimitStrategy(), config.ResetTrafficOnRenewal())
+	if err != nil {
+		if releaseErr := s.purchaseRepository.ReleaseProcessing(ctx, purchase.ID, purchase.Status); releaseErr != nil {
+			slog.Error("Error releasing purchase", "purchaseId", purchase.ID, "error", releaseErr)
+		}
+		alertProvisioning(purchase, customer, err)
+		return err
+	}
 
 	err = s.purchaseRepository.MarkAsPaid(ctx, purchase.ID)
 	if err != nil {
+		alertProvisioning(purchase, customer, err)
 		return err
 	}
 
+	err = s.campaignRepository.MarkConverted(ctx, purchase, time.Now().Add(-campaignAttributionWindow))
+	if err != nil {
+		slog.Error("Error tracking campaign conversion", "purchaseId", purchase.ID, "error", err)
+	}
+
 	customerFilesToUpdate := map[string]interface{}{
 		"subscription_link": user.SubscriptionUrl,
 		"expire_at":         user.ExpireAt,
+		"archived_at":       nil,
+		"panel_id":          panelID,
+		"remnawave_uuid":    user.UUID,
 	}
 
 	err = s.customerRepository.UpdateFields(ctx, customer.ID, customerFilesToUpdate)
 	if err != nil {
+		alertProvisioning(purchase, customer, err)
 		return err
 	}
 
+	alert.Sendf(alert.Purchase, "Amount: %s %s\nTariff: %d months\nUser: %d %s\nPayment: %s #%d",
+		strconv.FormatFloat(purchase.Amount, 'f', -1, 64), purchase.Currency, purchase.Month,
+		customer.TelegramID, customer.Profile(), purchase.InvoiceType, purchase.ID)
+
 	_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: customer.TelegramID,
 		Text:   s.translation.GetText(customer.Language, "subscription_activated"),
@@ -107,28 +161,121 @@ func (s PaymentService) ProcessPurchaseById(ctx context.Context, purchaseId int6
 	if err != nil {
 		return err
 	}
-	refereeCustomer, err := s.customerRepository.FindByTelegramId(ctxReferee, referee.ReferrerID)
+	_, err = s.grantReferralBonus(ctxReferee, referee)
+	return err
+}
+
+// ProcessTelegramPayment provisions a received Telegram Stars payment. Telegram doesn't let the bot poll the payment
+// like the other providers, so a purchase that failed is kept as received and RetryReceivedPurchases retries it.
+func (s PaymentService) ProcessTelegramPayment(ctx context.Context, purchaseId int64) error {
+	err := s.ProcessPurchaseById(ctx, purchaseId)
+	if err == nil {
+		return nil
+	}
+	if updateErr := s.purchaseRepository.MarkAsReceived(ctx, purchaseId); updateErr != nil {
+		slog.Error("Error marking purchase received", "purchaseId", purchaseId, "error", updateErr)
+	}
+	return err
+}
+
+// RetryReceivedPurchases provisions the Telegram Stars payments that failed before, e.g. while the panel was down.
+func (s PaymentService) RetryReceivedPurchases(ctx context.Context) {
+	purchases, err := s.purchaseRepository.FindByInvoiceTypeAndStatus(ctx, database.InvoiceTypeTelegram, database.PurchaseStatusReceived)
 	if err != nil {
-		return err
+		slog.Error("Error finding received purchases", "error", err)
+		return
 	}
-	refereeUser, err := s.remnawaveClient.CreateOrUpdateUser(ctxReferee, refereeCustomer.ID, refereeCustomer.TelegramID, config.TrafficLimit(), config.GetReferralDays())
+
+	for _, purchase := range *purchases {
+		if err := s.ProcessPurchaseById(ctx, purchase.ID); err != nil {
+			slog.Error("Error retrying received purchase", "purchaseId", purchase.ID, "error", err)
+			continue
+		}
+		slog.Info("Received purchase processed", "purchaseId", purchase.ID)
+	}
+}
+
+// alertProvisioning reports a paid purchase that could not be provisioned. The invoice checkers retry pending
+// CryptoPay and YooKassa invoices and RetryReceivedPurchases retries Telegram Stars payments, so a lasting
+// failure is digested by the alert rate limiting. A purchase that failed after the panel user was extended
+// stays in processing and has to be checked by hand.
+func alertProvisioning(purchase *database.Purchase, customer *database.Customer, err error) {
+	alert.Sendf(alert.Provisioning, "Payment: %s #%d\nUser: %d %s\nError: %v",
+		purchase.InvoiceType, purchase.ID, customer.TelegramID, customer.Profile(), err)
+}
+
+// ClaimReferralBonuses grants the bonuses that were held back while the referrer
+// was not subscribed to the channel and returns how many of them were granted.
+func (s PaymentService) ClaimReferralBonuses(ctx context.Context, referrerId int64) (int, error) {
+	referrals, err := s.referralRepository.FindPendingBonusesByReferrer(ctx, referrerId)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	granted := 0
+	for _, referral := range referrals {
+		ok, err := s.grantReferralBonus(ctx, &referral)
+		if err != nil {
+			return granted, err
+		}
+		if ok {
+			granted++
+		}
+	}
+	return granted, nil
+}
+
+// grantReferralBonus extends the referrer's subscription and reports whether the bonus was granted. The bonus
+// is claimed before the panel is called, so a double tap or a claim racing the referee's purchase grants it once.
+func (s PaymentService) grantReferralBonus(ctx context.Context, referee *database.Referral) (bool, error) {
+	refereeCustomer, err := s.customerRepository.FindByTelegramId(ctx, referee.ReferrerID)
+	if err != nil {
+		return false, err
+	}
+
+	isMember, err := s.channelService.IsMember(ctx, refereeCustomer.TelegramID)
+	if err != nil {
+		return false, err
+	}
+	if !isMember {
+		_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:    refereeCustomer.TelegramID,
+			ParseMode: models.ParseModeHTML,
+			Text:      s.translation.GetText(refereeCustomer.Language, "referral_bonus_channel_required"),
+			ReplyMarkup: models.InlineKeyboardMarkup{
+				InlineKeyboard: s.channelService.SubscribeKeyboard(refereeCustomer.Language, CallbackClaimReferral),
+			},
+		})
+		return false, err
+	}
+
+	claimed, err := s.referralRepository.ClaimBonus(ctx, referee.ID)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	panelID, panelClient := s.panelFor(ctx, refereeCustomer, remnawave.TariffReferral)
+	refereeUser, err := panelClient.CreateOrUpdateUser(ctx, refereeCustomer.ID, refereeCustomer.TelegramID, refereeCustomer.RemnawaveUUID, refereeCustomer.Profile(), config.TrafficLimit(), config.GetReferralDays(), config.TrafficLimitStrategy(), false)
+	if err != nil {
+		if releaseErr := s.referralRepository.ReleaseBonus(ctx, referee.ID); releaseErr != nil {
+			slog.Error("Failed to release referral bonus", "referral_id", referee.ID, "error", releaseErr)
+		}
+		return false, err
 	}
 	refereeUserFilesToUpdate := map[string]interface{}{
 		"subscription_link": refereeUser.GetSubscriptionUrl(),
 		"expire_at":         refereeUser.GetExpireAt(),
+		"panel_id":          panelID,
+		"remnawave_uuid":    refereeUser.UUID,
 	}
-	err = s.customerRepository.UpdateFields(ctxReferee, refereeCustomer.ID, refereeUserFilesToUpdate)
+	err = s.customerRepository.UpdateFields(ctx, refereeCustomer.ID, refereeUserFilesToUpdate)
 	if err != nil {
-		return err
-	}
-	err = s.referralRepository.MarkBonusGranted(ctxReferee, referee.ID)
-	if err != nil {
-		return err
+		return true, err
 	}
 	slog.Info("Granted referral bonus", "customer_id", refereeCustomer.ID)
-	_, err = s.telegramBot.SendMessage(ctxReferee, &bot.SendMessageParams{
+	_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:    refereeCustomer.TelegramID,
 		ParseMode: models.ParseModeHTML,
 		Text:      s.translation.GetText(refereeCustomer.Language, "referral_bonus_granted"),
@@ -137,7 +284,17 @@ func (s PaymentService) ProcessPurchaseById(ctx context.Context, purchaseId int6
 		},
 	})
 
-	return nil
+	return true, nil
+}
+
+// panelFor returns the panel of the customer. Customers without a subscription are placed on a panel
+// according to PANEL_PLACEMENT, while existing subscriptions without a panel stay on the default one.
+func (s PaymentService) panelFor(ctx context.Context, customer *database.Customer, tariff string) (string, *remnawave.Client) {
+	if customer.PanelID == nil && (customer.SubscriptionLink == nil || *customer.SubscriptionLink == "") {
+		panelID := s.panels.Place(ctx, tariff)
+		return panelID, s.panels.Get(&panelID)
+	}
+	return s.panels.Name(customer.PanelID), s.panels.Get(customer.PanelID)
 }
 
 func (s PaymentService) createConnectKeyboard(customer *database.Customer) [][]models.InlineKeyboardButton {
@@ -161,28 +318,43 @@ func (s PaymentService) createConnectKeyboard(customer *database.Customer) [][]m
 	return inlineCustomerKeyboard
 }
 
-func (s PaymentService) CreatePurchase(ctx context.Context, amount int, months int, customer *database.Customer, invoiceType database.InvoiceType) (string, error) {
+// CreatePurchase creates the invoice for the tariff of the given months. The price is taken from the config
+// with the personal win-back discount that is active right now; the discount is used up when the purchase is paid.
+func (s PaymentService) CreatePurchase(ctx context.Context, months int, customer *database.Customer, invoiceType database.InvoiceType) (string, error) {
+	amount := config.Price(months)
+	if amount <= 0 {
+		return "", fmt.Errorf("no tariff for %d months", months)
+	}
+
+	purchase := &database.Purchase{CustomerID: customer.ID, Month: months}
+	discount, err := s.campaignRepository.FindActiveDiscount(ctx, customer.ID)
+	if err != nil {
+		slog.Error("Error finding campaign discount", "customerId", customer.ID, "error", err)
+	}
+	if discount != nil {
+		amount = discount.Apply(amount)
+		purchase.CampaignDeliveryID = &discount.ID
+	}
+	purchase.Amount = float64(amount)
+
 	switch invoiceType {
 	case database.InvoiceTypeCrypto:
-		return s.createCryptoInvoice(ctx, amount, months, customer)
+		return s.createCryptoInvoice(ctx, purchase, customer)
 	case database.InvoiceTypeYookasa:
-		return s.createYookasaInvoice(ctx, amount, months, customer)
+		return s.createYookasaInvoice(ctx, purchase, customer)
 	case database.InvoiceTypeTelegram:
-		return s.createTelegramInvoice(ctx, amount, months, customer)
+		return s.createTelegramInvoice(ctx, purchase, customer)
 	default:
 		return "", fmt.Errorf("unknown invoice type: %s", invoiceType)
 	}
 }
 
-func (s PaymentService) createCryptoInvoice(ctx context.Context, amount int, months int, customer *database.Customer) (string, error) {
-	purchaseId, err := s.purchaseRepository.Create(ctx, &database.Purchase{
-		InvoiceType: database.InvoiceTypeCrypto,
-		Status:      database.PurchaseStatusNew,
-		Amount:      float64(amount),
-		Currency:    "RUB",
-		CustomerID:  customer.ID,
-		Month:       months,
-	})
+func (s PaymentService) createCryptoInvoice(ctx context.Context, purchase *database.Purchase, customer *database.Customer) (string, error) {
+	amount, months := int(purchase.Amount), purchase.Month
+	purchase.InvoiceType = database.InvoiceTypeCrypto
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = "RUB"
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
 	if err != nil {
 		slog.Error("Error creating purchase", err)
 		return "", err
@@ -193,13 +365,14 @@ func (s PaymentService) createCryptoInvoice(ctx context.Context, amount int, mon
 		Fiat:           "RUB",
 		Amount:         fmt.Sprintf("%d", amount),
 		AcceptedAssets: "USDT",
-		Payload:        fmt.Sprintf("purchaseId=%d&username=%s", purchaseId, ctx.Value("username")),
+		Payload:        fmt.Sprintf("purchaseId=%d", purchaseId),
 		Description:    fmt.Sprintf("Subscription on %d month", months),
 		PaidBtnName:    "callback",
 		PaidBtnUrl:     config.BotURL(),
 	})
 	if err != nil {
 		slog.Error("Error creating invoice", err)
+		alert.Sendf(alert.ProviderError, "CryptoPay: failed to create invoice for purchase #%d: %v", purchaseId, err)
 		return "", err
 	}
 
@@ -218,23 +391,21 @@ func (s PaymentService) createCryptoInvoice(ctx context.Context, amount int, mon
 	return invoice.BotInvoiceUrl, nil
 }
 
-func (s PaymentService) createYookasaInvoice(ctx context.Context, amount int, months int, customer *database.Customer) (string, error) {
-	purchaseId, err := s.purchaseRepository.Create(ctx, &database.Purchase{
-		InvoiceType: database.InvoiceTypeYookasa,
-		Status:      database.PurchaseStatusNew,
-		Amount:      float64(amount),
-		Currency:    "RUB",
-		CustomerID:  customer.ID,
-		Month:       months,
-	})
+func (s PaymentService) createYookasaInvoice(ctx context.Context, purchase *database.Purchase, customer *database.Customer) (string, error) {
+	amount, months := int(purchase.Amount), purchase.Month
+	purchase.InvoiceType = database.InvoiceTypeYookasa
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = "RUB"
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
 	if err != nil {
 		slog.Error("Error creating purchase", err)
 		return "", err
 	}
 
-	invoice, err := s.yookasaClient.CreateInvoice(ctx, amount, months, customer.ID, purchaseId)
+	invoice, err := s.yookasaClient.CreateInvoice(ctx, amount, months, customer.ID, purchaseId, customer.Profile())
 	if err != nil {
 		slog.Error("Error creating invoice", err)
+		alert.Sendf(alert.ProviderError, "YooKassa: failed to create invoice for purchase #%d: %v", purchaseId, err)
 		return "", err
 	}
 
@@ -253,15 +424,12 @@ func (s PaymentService) createYookasaInvoice(ctx context.Context, amount int, mo
 	return invoice.Confirmation.ConfirmationURL, nil
 }
 
-func (s PaymentService) createTelegramInvoice(ctx context.Context, amount int, months int, customer *database.Customer) (string, error) {
-	purchaseId, err := s.purchaseRepository.Create(ctx, &database.Purchase{
-		InvoiceType: database.InvoiceTypeTelegram,
-		Status:      database.PurchaseStatusNew,
-		Amount:      float64(amount),
-		Currency:    "STARS",
-		CustomerID:  customer.ID,
-		Month:       months,
-	})
+func (s PaymentService) createTelegramInvoice(ctx context.Context, purchase *database.Purchase, customer *database.Customer) (string, error) {
+	amount := int(purchase.Amount)
+	purchase.InvoiceType = database.InvoiceTypeTelegram
+	purchase.Status = database.PurchaseStatusNew
+	purchase.Currency = "STARS"
+	purchaseId, err := s.purchaseRepository.Create(ctx, purchase)
 	if err != nil {
 		slog.Error("Error creating purchase", err)
 		return "", nil
@@ -277,8 +445,13 @@ func (s PaymentService) createTelegramInvoice(ctx context.Context, amount int, m
 			},
 		},
 		Description: s.translation.GetText(customer.Language, "invoice_description"),
-		Payload:     fmt.Sprintf("%d&%s", purchaseId, ctx.Value("username")),
+		Payload:     strconv.FormatInt(purchaseId, 10),
 	})
+	if err != nil {
+		slog.Error("Error creating invoice link", "error", err)
+		alert.Sendf(alert.ProviderError, "Telegram Stars: failed to create invoice for purchase #%d: %v", purchaseId, err)
+		return "", err
+	}
 
 	updates := map[string]interface{}{
 		"status": database.PurchaseStatusPending,
@@ -305,15 +478,30 @@ func (s PaymentService) ActivateTrial(ctx context.Context, telegramId int64) (st
 	if customer == nil {
 		return "", fmt.Errorf("customer %d not found", telegramId)
 	}
-	user, err := s.remnawaveClient.CreateOrUpdateUser(ctx, customer.ID, telegramId, config.TrialTrafficLimit(), config.TrialDays())
+
+	claimed, err := s.trialRepository.Claim(ctx, telegramId)
 	if err != nil {
-		slog.Error("Error creating user", err)
+		return "", err
+	}
+	if !claimed {
+		return "", ErrTrialAlreadyUsed
+	}
+
+	panelID, panelClient := s.panelFor(ctx, customer, remnawave.TariffTrial)
+	user, err := panelClient.CreateOrUpdateUser(ctx, customer.ID, telegramId, customer.RemnawaveUUID, customer.Profile(), config.TrialTrafficLimit(), config.TrialDays(), config.TrialTrafficLimitStrategy(), false)
+	if err != nil {
+		slog.Error("Error creating user", "error", err)
+		if releaseErr := s.trialRepository.Release(ctx, telegramId); releaseErr != nil {
+			slog.Error("Error releasing trial", "telegramId", telegramId, "error", releaseErr)
+		}
 		return "", err
 	}
 
 	customerFilesToUpdate := map[string]interface{}{
 		"subscription_link": user.GetSubscriptionUrl(),
 		"expire_at":         user.GetExpireAt(),
+		"panel_id":          panelID,
+		"remnawave_uuid":    user.UUID,
 	}
 
 	err = s.customerRepository.UpdateFields(ctx, customer.ID, customerFilesToUpdate)
@@ -325,6 +513,44 @@ func (s PaymentService) ActivateTrial(ctx context.Context, telegramId int64) (st
 
 }
 
+func (s PaymentService) ResetSubscriptionLink(ctx context.Context, customer *database.Customer) (string, error) {
+	claimed, err := s.customerRepository.ClaimLinkReset(ctx, customer.ID, config.LinkResetCooldown())
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		current, err := s.customerRepository.FindById(ctx, customer.ID)
+		if err != nil {
+			return "", err
+		}
+		if current != nil && current.LinkResetAt != nil {
+			customer.LinkResetAt = current.LinkResetAt
+		}
+		return "", ErrLinkResetTooSoon
+	}
+
+	subscriptionUrl, err := s.panels.Get(customer.PanelID).RevokeSubscription(ctx, customer.RemnawaveUUID, customer.TelegramID)
+	if err != nil {
+		// the link was not reset, so the cooldown must not start
+		if releaseErr := s.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{"link_reset_at": customer.LinkResetAt}); releaseErr != nil {
+			slog.Error("Failed to release link reset", "customer_id", customer.ID, "error", releaseErr)
+		}
+		return "", err
+	}
+
+	now := time.Now()
+	customer.LinkResetAt = &now
+	err = s.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{
+		"subscription_link": subscriptionUrl,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("Subscription link reset", "customer_id", customer.ID)
+	return subscriptionUrl, nil
+}
+
 func (s PaymentService) CancelPayment(purchaseId int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -2,10 +2,12 @@ package remnawave
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	remapi "github.com/Jolymmiles/remnawave-api-go/api"
 	"github.com/google/uuid"
+	"log/slog"
 	"net/http"
 	"remnawave-tg-shop-bot/internal/config"
 	"strconv"
@@ -14,7 +16,10 @@ import (
 )
 
 type Client struct {
-	client *remapi.Client
+	client     *remapi.Client
+	httpClient *http.Client
+	baseURL    string
+	token      string
 }
 
 type headerTransport struct {
@@ -27,98 +32,315 @@ func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.base.RoundTrip(req)
 }
 
-func NewClient(baseURL, token, mode string) *Client {
-	client := &http.Client{}
+func NewClient(name, baseURL, token, mode string) *Client {
+	var transport http.RoundTripper = http.DefaultTransport
 	if mode == "local" {
-		client.Transport = &headerTransport{
+		transport = &headerTransport{
 			base: http.DefaultTransport,
 		}
 	}
+	client := &http.Client{
+		Timeout: config.RemnawaveTimeout(),
+		Transport: &resilientTransport{
+			base:    transport,
+			retries: config.RemnawaveRetries(),
+			breaker: &breaker{},
+			metrics: metricsFor(name),
+		},
+	}
 	remnawaveApi, err := remapi.NewClient(baseURL, remapi.StaticToken{Token: token}, remapi.WithClient(client))
 	if err != nil {
 		panic(err)
 	}
-	return &Client{client: remnawaveApi}
+	return &Client{client: remnawaveApi, httpClient: client, baseURL: baseURL, token: token}
 }
 
 func (r *Client) GetUsers(ctx context.Context) (*[]remapi.UserDto, error) {
+	users := make([]remapi.UserDto, 0)
+	err := r.ForEachUsersPage(ctx, func(page []remapi.UserDto) error {
+		users = append(users, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &users, nil
+}
+
+// ForEachUsersPage pages through the panel users and calls fn for every page, so callers
+// don't have to keep the whole user list in memory.
+func (r *Client) ForEachUsersPage(ctx context.Context, fn func(page []remapi.UserDto) error) error {
 	pageSize := float64(250)
 	start := float64(0)
 
-	users := make([]remapi.UserDto, 0)
 	for {
 		resp, err := r.client.UsersControllerGetAllUsersV2(ctx,
 			remapi.UsersControllerGetAllUsersV2Params{Size: remapi.NewOptFloat64(pageSize), Start: remapi.NewOptFloat64(start)})
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 		response := resp.GetResponse()
 
-		usersResponse := &response.Users
+		if err := fn(response.Users); err != nil {
+			return err
+		}
 
-		users = append(users, *usersResponse...)
+		start += float64(len(response.Users))
 
-		start += float64(len(*usersResponse))
+		if len(response.Users) == 0 || start >= response.GetTotal() {
+			return nil
+		}
+	}
+}
 
-		if start >= response.GetTotal() {
-			break
+// CreateOrUpdateUser extends the subscription of the customer's panel user by days or creates the user.
+// The description, usually the customer's telegram profile, is written to the panel user when not empty.
+func (r *Client) CreateOrUpdateUser(ctx context.Context, customerId int64, telegramId int64, userUUID *uuid.UUID, description string, trafficLimit int, days int, trafficStrategy string, resetTraffic bool) (*remapi.UserDto, error) {
+	existingUser, err := r.GetUser(ctx, userUUID, telegramId)
+	if err != nil {
+		return nil, err
+	}
+
+	if existingUser == nil {
+		return r.createUser(ctx, customerId, telegramId, description, trafficLimit, time.Now().UTC().AddDate(0, 0, days), trafficStrategy)
+	}
+	return r.updateUser(ctx, existingUser, description, trafficLimit, days, trafficStrategy, resetTraffic)
+}
+
+func (r *Client) GetUserByTelegramId(ctx context.Context, telegramId int64) (*remapi.UserDto, error) {
+	return r.GetUser(ctx, nil, telegramId)
+}
+
+// GetUser returns the panel user stored for the customer. The stored UUID is looked up directly, so the user
+// is found even if its telegram id was changed in the panel. Customers without a stored UUID, or whose user
+// was deleted, get the user picked by PickUser from the users of their telegram id, or nil.
+func (r *Client) GetUser(ctx context.Context, userUUID *uuid.UUID, telegramId int64) (*remapi.UserDto, error) {
+	if userUUID != nil {
+		user, err := r.GetUserByUUID(ctx, *userUUID)
+		if err != nil || user != nil {
+			return user, err
 		}
 	}
 
-	return &users, nil
+	users, err := r.GetUsersByTelegramId(ctx, telegramId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) > 1 {
+		slog.Warn("Several panel users for telegram id", "telegramId", telegramId, "count", len(users))
+	}
+	return PickUser(users, telegramId), nil
 }
 
-func (r *Client) CreateOrUpdateUser(ctx context.Context, customerId int64, telegramId int64, trafficLimit int, days int) (*remapi.UserDto, error) {
-	resp, err := r.client.UsersControllerGetUserByTelegramId(ctx, remapi.UsersControllerGetUserByTelegramIdParams{TelegramId: strconv.FormatInt(telegramId, 10)})
+// GetUserByUUID returns the panel user with the UUID, or nil if it doesn't exist.
+func (r *Client) GetUserByUUID(ctx context.Context, userUUID uuid.UUID) (*remapi.UserDto, error) {
+	resp, err := r.client.UsersControllerGetUserByUuid(ctx, remapi.UsersControllerGetUserByUuidParams{UUID: userUUID.String()})
 	if err != nil {
 		return nil, err
 	}
 
 	switch v := resp.(type) {
+	case *remapi.UsersControllerGetUserByUuidNotFound:
+		return nil, nil
+	case *remapi.GetUserByUuidResponseDto:
+		// the response has its own type with the same fields as UserDto
+		data, err := json.Marshal(&v.Response)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode user %s: %w", userUUID, err)
+		}
+		var user remapi.UserDto
+		if err := json.Unmarshal(data, &user); err != nil {
+			return nil, fmt.Errorf("failed to decode user %s: %w", userUUID, err)
+		}
+		return &user, nil
+	default:
+		return nil, errors.New("unknown response type")
+	}
+}
+
+func (r *Client) GetUsersByTelegramId(ctx context.Context, telegramId int64) ([]remapi.UserDto, error) {
+	resp, err := r.client.UsersControllerGetUserByTelegramId(ctx, remapi.UsersControllerGetUserByTelegramIdParams{TelegramId: strconv.FormatInt(telegramId, 10)})
+	if err != nil {
+		return nil, err
+	}
 
+	switch v := resp.(type) {
 	case *remapi.UsersControllerGetUserByTelegramIdNotFound:
-		return r.createUser(ctx, customerId, telegramId, trafficLimit, days)
+		return nil, nil
 	case *remapi.GetUserByTelegramIdResponseDto:
-		var existingUser *remapi.UserDto
-		for _, panelUser := range v.GetResponse() {
-			if strings.Contains(panelUser.Username, fmt.Sprintf("_%d", telegramId)) {
-				existingUser = &panelUser
-			}
+		return v.GetResponse(), nil
+	default:
+		return nil, errors.New("unknown response type")
+	}
+}
+
+// PickUser deterministically chooses one of several panel users of a telegram id: users created by the bot
+// (username ending with _<telegramId>) win, then the one expiring last, then the first username.
+func PickUser(users []remapi.UserDto, telegramId int64) *remapi.UserDto {
+	if len(users) == 0 {
+		return nil
+	}
+
+	suffix := fmt.Sprintf("_%d", telegramId)
+	var picked *remapi.UserDto
+	for i := range users {
+		user := &users[i]
+		if picked == nil {
+			picked = user
+			continue
 		}
-		if existingUser == nil {
-			existingUser = &v.GetResponse()[0]
+		userOwned, pickedOwned := strings.HasSuffix(user.Username, suffix), strings.HasSuffix(picked.Username, suffix)
+		switch {
+		case userOwned != pickedOwned:
+			if userOwned {
+				picked = user
+			}
+		case !user.ExpireAt.Equal(picked.ExpireAt):
+			if user.ExpireAt.After(picked.ExpireAt) {
+				picked = user
+			}
+		case user.Username < picked.Username:
+			picked = user
 		}
-		return r.updateUser(ctx, existingUser, trafficLimit, days)
+	}
+	return picked
+}
+
+func (r *Client) DisableUser(ctx context.Context, userUUID *uuid.UUID, telegramId int64) error {
+	existingUser, err := r.GetUser(ctx, userUUID, telegramId)
+	if err != nil {
+		return err
+	}
+	if existingUser == nil {
+		return nil
+	}
+
+	resp, err := r.client.UsersControllerDisableUser(ctx, remapi.UsersControllerDisableUserParams{UUID: existingUser.UUID.String()})
+	if err != nil {
+		return err
+	}
+
+	switch resp.(type) {
+	case *remapi.DisableUserResponseDto, *remapi.UsersControllerDisableUserNotFound:
+		return nil
 	default:
-		return nil, errors.New("unknown response type")
+		return errors.New("unknown response type")
 	}
 }
 
-func (r *Client) updateUser(ctx context.Context, existingUser *remapi.UserDto, trafficLimit int, days int) (*remapi.UserDto, error) {
+func (r *Client) DeleteUser(ctx context.Context, userUUID uuid.UUID) error {
+	resp, err := r.client.UsersControllerDeleteUser(ctx, remapi.UsersControllerDeleteUserParams{UUID: userUUID.String()})
+	if err != nil {
+		return err
+	}
+
+	switch resp.(type) {
+	case *remapi.DeleteUserResponseDto, *remapi.UsersControllerDeleteUserNotFound:
+		return nil
+	default:
+		return errors.New("unknown response type")
+	}
+}
+
+func (r *Client) SetExpireAt(ctx context.Context, userUUID uuid.UUID, expireAt time.Time) (*remapi.UserDto, error) {
+	updateUser, err := r.client.UsersControllerUpdateUser(ctx, &remapi.UpdateUserRequestDto{
+		UUID:     userUUID,
+		ExpireAt: remapi.NewOptDateTime(expireAt),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updateUser.Response, nil
+}
+
+func (r *Client) SetDescription(ctx context.Context, userUUID uuid.UUID, description string) error {
+	_, err := r.client.UsersControllerUpdateUser(ctx, &remapi.UpdateUserRequestDto{
+		UUID:        userUUID,
+		Description: remapi.NewOptNilString(description),
+	})
+	return err
+}
+
+func (r *Client) RevokeSubscription(ctx context.Context, userUUID *uuid.UUID, telegramId int64) (string, error) {
+	existingUser, err := r.GetUser(ctx, userUUID, telegramId)
+	if err != nil {
+		return "", err
+	}
+	if existingUser == nil {
+		return "", fmt.Errorf("user with telegram id %d not found", telegramId)
+	}
+
+	resp, err := r.client.UsersControllerRevokeUserSubscription(ctx, remapi.UsersControllerRevokeUserSubscriptionParams{UUID: existingUser.UUID.String()})
+	if err != nil {
+		return "", err
+	}
+
+	switch v := resp.(type) {
+	case *remapi.RevokeUserSubscriptionResponseDto:
+		return v.Response.SubscriptionUrl, nil
+	case *remapi.UsersControllerRevokeUserSubscriptionNotFound:
+		return "", fmt.Errorf("user %s not found while revoking subscription", existingUser.UUID)
+	default:
+		return "", errors.New("unknown response type")
+	}
+}
+
+func (r *Client) updateUser(ctx context.Context, existingUser *remapi.UserDto, description string, trafficLimit int, days int, trafficStrategy string, resetTraffic bool) (*remapi.UserDto, error) {
 
 	newExpire := getNewExpire(days, existingUser.ExpireAt)
 
 	userUpdate := &remapi.UpdateUserRequestDto{
-		UUID:              existingUser.UUID,
-		ExpireAt:          remapi.NewOptDateTime(newExpire),
-		Status:            remapi.NewOptUpdateUserRequestDtoStatus(remapi.UpdateUserRequestDtoStatusACTIVE),
-		TrafficLimitBytes: remapi.NewOptInt(trafficLimit),
+		UUID:                 existingUser.UUID,
+		ExpireAt:             remapi.NewOptDateTime(newExpire),
+		Status:               remapi.NewOptUpdateUserRequestDtoStatus(remapi.UpdateUserRequestDtoStatusACTIVE),
+		TrafficLimitBytes:    remapi.NewOptInt(trafficLimit),
+		TrafficLimitStrategy: remapi.NewOptUpdateUserRequestDtoTrafficLimitStrategy(remapi.UpdateUserRequestDtoTrafficLimitStrategy(trafficStrategy)),
 	}
 
-	if ctx.Value("username") != nil {
-		userUpdate.Description = remapi.NewOptNilString(ctx.Value("username").(string))
+	if description != "" {
+		userUpdate.Description = remapi.NewOptNilString(description)
 	}
 
 	updateUser, err := r.client.UsersControllerUpdateUser(ctx, userUpdate)
 	if err != nil {
 		return nil, err
 	}
+
+	if resetTraffic {
+		if err := r.resetUserTraffic(ctx, existingUser.UUID); err != nil {
+			return nil, err
+		}
+		updateUser.Response.UsedTrafficBytes = 0
+	}
 	return &updateUser.Response, nil
 }
 
-func (r *Client) createUser(ctx context.Context, customerId int64, telegramId int64, trafficLimit int, days int) (*remapi.UserDto, error) {
-	expireAt := time.Now().UTC().AddDate(0, 0, days)
+func (r *Client) resetUserTraffic(ctx context.Context, userUUID uuid.UUID) error {
+	resp, err := r.client.UsersControllerResetUserTraffic(ctx, remapi.UsersControllerResetUserTrafficParams{UUID: userUUID.String()})
+	if err != nil {
+		return err
+	}
+
+	switch resp.(type) {
+	case *remapi.ResetUserTrafficResponseDto:
+		return nil
+	case *remapi.UsersControllerResetUserTrafficNotFound:
+		return fmt.Errorf("user %s not found while resetting traffic", userUUID)
+	default:
+		return errors.New("unknown response type")
+	}
+}
+
+// RestoreUser creates the panel user again with the expiration date kept in the bot, e.g. after
+// the user was deleted from the panel by mistake.
+func (r *Client) RestoreUser(ctx context.Context, customerId int64, telegramId int64, description string, trafficLimit int, expireAt time.Time, trafficStrategy string) (*remapi.UserDto, error) {
+	return r.createUser(ctx, customerId, telegramId, description, trafficLimit, expireAt, trafficStrategy)
+}
+
+func (r *Client) createUser(ctx context.Context, customerId int64, telegramId int64, description string, trafficLimit int, expireAt time.Time, trafficStrategy string) (*remapi.UserDto, error) {
 	username := generateUsername(customerId, telegramId)
 
 	resp, err := r.client.InboundsControllerGetInbounds(ctx)
@@ -146,12 +368,12 @@ func (r *Client) createUser(ctx context.Context, customerId int64, telegramId in
 		Status:               remapi.NewOptCreateUserRequestDtoStatus(remapi.CreateUserRequestDtoStatusACTIVE),
 		TelegramId:           remapi.NewOptInt(int(telegramId)),
 		ExpireAt:             expireAt,
-		TrafficLimitStrategy: remapi.CreateUserRequestDtoTrafficLimitStrategyMONTH,
+		TrafficLimitStrategy: remapi.CreateUserRequestDtoTrafficLimitStrategy(trafficStrategy),
 		TrafficLimitBytes:    remapi.NewOptInt(trafficLimit),
 	}
 
-	if ctx.Value("username") != nil {
-		createUserRequestDto.Description = remapi.NewOptString(ctx.Value("username").(string))
+	if description != "" {
+		createUserRequestDto.Description = remapi.NewOptString(description)
 	}
 
 	userCreate, err := r.client.UsersControllerCreateUser(ctx, &createUserRequestDto)
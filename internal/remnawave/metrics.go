@@ -0,0 +1,148 @@
+package remnawave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the panel latency histogram.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]*panelMetrics)
+)
+
+type panelMetrics struct {
+	panel string
+
+	mu       sync.Mutex
+	requests uint64
+	errors   uint64
+	rejected uint64
+	buckets  []uint64
+	sum      float64
+}
+
+func metricsFor(panel string) *panelMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if m, ok := metrics[panel]; ok {
+		return m
+	}
+	m := &panelMetrics{panel: panel, buckets: make([]uint64, len(latencyBuckets))}
+	metrics[panel] = m
+	return m
+}
+
+func (m *panelMetrics) observe(latency time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests++
+	if failed {
+		m.errors++
+	}
+	seconds := latency.Seconds()
+	m.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+}
+
+func (m *panelMetrics) observeRejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rejected++
+}
+
+// ServeMetrics serves the panel request metrics on /metrics until the context is cancelled.
+func ServeMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down metrics server", "error", err)
+		}
+	}()
+
+	slog.Info("Metrics server is starting", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Metrics server stopped", "error", err)
+	}
+}
+
+// WriteMetrics writes the panel request metrics in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	panels := make([]*panelMetrics, 0, len(metrics))
+	for _, m := range metrics {
+		panels = append(panels, m)
+	}
+	metricsMu.Unlock()
+	sort.Slice(panels, func(i, j int) bool { return panels[i].panel < panels[j].panel })
+
+	fmt.Fprintln(w, "# HELP remnawave_requests_total Requests sent to the Remnawave panel.")
+	fmt.Fprintln(w, "# TYPE remnawave_requests_total counter")
+	for _, m := range panels {
+		m.mu.Lock()
+		fmt.Fprintf(w, "remnawave_requests_total{panel=%q} %d\n", m.panel, m.requests)
+		m.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP remnawave_request_errors_total Requests that failed with a network error, 429 or 5xx.")
+	fmt.Fprintln(w, "# TYPE remnawave_request_errors_total counter")
+	for _, m := range panels {
+		m.mu.Lock()
+		fmt.Fprintf(w, "remnawave_request_errors_total{panel=%q} %d\n", m.panel, m.errors)
+		m.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP remnawave_requests_rejected_total Requests rejected by the open circuit breaker.")
+	fmt.Fprintln(w, "# TYPE remnawave_requests_rejected_total counter")
+	for _, m := range panels {
+		m.mu.Lock()
+		fmt.Fprintf(w, "remnawave_requests_rejected_total{panel=%q} %d\n", m.panel, m.rejected)
+		m.mu.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP remnawave_request_duration_seconds Latency of the requests to the Remnawave panel.")
+	fmt.Fprintln(w, "# TYPE remnawave_request_duration_seconds histogram")
+	for _, m := range panels {
+		m.mu.Lock()
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "remnawave_request_duration_seconds_bucket{panel=%q,le=\"%g\"} %d\n", m.panel, bound, m.buckets[i])
+		}
+		fmt.Fprintf(w, "remnawave_request_duration_seconds_bucket{panel=%q,le=\"+Inf\"} %d\n", m.panel, m.requests)
+		fmt.Fprintf(w, "remnawave_request_duration_seconds_sum{panel=%q} %g\n", m.panel, m.sum)
+		fmt.Fprintf(w, "remnawave_request_duration_seconds_count{panel=%q} %d\n", m.panel, m.requests)
+		m.mu.Unlock()
+	}
+}
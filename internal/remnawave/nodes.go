@@ -0,0 +1,60 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type Node struct {
+	UUID              string   `json:"uuid"`
+	Name              string   `json:"name"`
+	Address           string   `json:"address"`
+	CountryCode       string   `json:"countryCode"`
+	IsConnected       bool     `json:"isConnected"`
+	IsDisabled        bool     `json:"isDisabled"`
+	IsNodeOnline      bool     `json:"isNodeOnline"`
+	IsXrayRunning     bool     `json:"isXrayRunning"`
+	UsersOnline       *int     `json:"usersOnline"`
+	TrafficUsedBytes  *float64 `json:"trafficUsedBytes"`
+	TrafficLimitBytes *float64 `json:"trafficLimitBytes"`
+}
+
+func (n Node) IsOnline() bool {
+	return n.IsConnected && n.IsNodeOnline && n.IsXrayRunning && !n.IsDisabled
+}
+
+// GetNodes is implemented without the generated client: the panel returns the nodes
+// wrapped in {"response": [...]}, while the OpenAPI spec declares a plain array.
+func (r *Client) GetNodes(ctx context.Context) ([]Node, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(r.baseURL, "/")+"/api/nodes/get-all", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nodes request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nodes response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected nodes response status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var nodesResponse struct {
+		Response []Node `json:"response"`
+	}
+	if err := json.Unmarshal(body, &nodesResponse); err != nil {
+		return nil, fmt.Errorf("failed to decode nodes response: %w", err)
+	}
+	return nodesResponse.Response, nil
+}
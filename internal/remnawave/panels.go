@@ -0,0 +1,139 @@
+package remnawave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"sync/atomic"
+)
+
+const (
+	TariffTrial    = "trial"
+	TariffReferral = "referral"
+)
+
+// Panels is the set of Remnawave installations the shop fronts. Customers without a panel
+// are served by the first one, which is where all users lived before multi-panel support.
+type Panels struct {
+	configs   []config.PanelConfig
+	clients   map[string]*Client
+	placement string
+	next      atomic.Uint64
+}
+
+func NewPanels(configs []config.PanelConfig, placement string) *Panels {
+	p := &Panels{
+		configs:   configs,
+		clients:   make(map[string]*Client, len(configs)),
+		placement: placement,
+	}
+	for _, panel := range configs {
+		p.clients[panel.Name] = NewClient(panel.Name, panel.URL, panel.Token, panel.Mode)
+	}
+	return p
+}
+
+// Names returns the panel names in the configured order.
+func (p *Panels) Names() []string {
+	names := make([]string, 0, len(p.configs))
+	for _, panel := range p.configs {
+		names = append(names, panel.Name)
+	}
+	return names
+}
+
+func (p *Panels) Default() *Client {
+	return p.clients[p.configs[0].Name]
+}
+
+// Get returns the client of the customer's panel, or the default panel if it is not set or no longer configured.
+func (p *Panels) Get(panelID *string) *Client {
+	if panelID == nil {
+		return p.Default()
+	}
+	if client, ok := p.clients[*panelID]; ok {
+		return client
+	}
+	slog.Warn("Panel is not configured, using default", "panel", *panelID)
+	return p.Default()
+}
+
+// Name returns the name of the customer's panel, following the same fallback as Get.
+func (p *Panels) Name(panelID *string) string {
+	if panelID != nil {
+		if _, ok := p.clients[*panelID]; ok {
+			return *panelID
+		}
+	}
+	return p.configs[0].Name
+}
+
+// Place picks the panel for a new user according to PANEL_PLACEMENT. The tariff is the number
+// of purchased months, TariffTrial or TariffReferral.
+func (p *Panels) Place(ctx context.Context, tariff string) string {
+	if len(p.configs) == 1 {
+		return p.configs[0].Name
+	}
+
+	switch p.placement {
+	case config.PlacementRoundRobin:
+		return p.configs[(p.next.Add(1)-1)%uint64(len(p.configs))].Name
+	case config.PlacementByTariff:
+		for _, panel := range p.configs {
+			if panel.Tariffs[tariff] {
+				return panel.Name
+			}
+		}
+		for _, panel := range p.configs {
+			if len(panel.Tariffs) == 0 {
+				return panel.Name
+			}
+		}
+		return p.configs[0].Name
+	default:
+		for _, panel := range p.configs {
+			if panel.Capacity == 0 {
+				return panel.Name
+			}
+			count, err := p.clients[panel.Name].CountUsers(ctx)
+			if err != nil {
+				slog.Error("Error counting panel users", "panel", panel.Name, "error", err)
+				continue
+			}
+			if count < panel.Capacity {
+				return panel.Name
+			}
+		}
+		slog.Warn("All panels are full, using default")
+		return p.configs[0].Name
+	}
+}
+
+// GetNodes returns the nodes of all panels. Nodes of the reachable panels are returned
+// even if some panels fail, together with the error.
+func (p *Panels) GetNodes(ctx context.Context) ([]Node, error) {
+	var nodes []Node
+	var errs []error
+	for _, panel := range p.configs {
+		panelNodes, err := p.clients[panel.Name].GetNodes(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("panel %s: %w", panel.Name, err))
+			continue
+		}
+		nodes = append(nodes, panelNodes...)
+	}
+	return nodes, errors.Join(errs...)
+}
+
+func (r *Client) CountUsers(ctx context.Context) (int, error) {
+	resp, err := r.client.UsersControllerGetAllUsersV2(ctx,
+		remapi.UsersControllerGetAllUsersV2Params{Size: remapi.NewOptFloat64(1), Start: remapi.NewOptFloat64(0)})
+	if err != nil {
+		return 0, err
+	}
+	response := resp.GetResponse()
+	return int(response.GetTotal()), nil
+}
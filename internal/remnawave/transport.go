@@ -0,0 +1,153 @@
+package remnawave
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"remnawave-tg-shop-bot/internal/alert"
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay   = 200 * time.Millisecond
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// ErrUnavailable is returned without calling the panel while the circuit breaker is open.
+var ErrUnavailable = errors.New("remnawave is temporarily unavailable")
+
+// resilientTransport retries idempotent requests with jittered backoff, opens the circuit breaker
+// after breakerThreshold consecutive failures and records the panel metrics.
+type resilientTransport struct {
+	base    http.RoundTripper
+	retries int
+	breaker *breaker
+	metrics *panelMetrics
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		t.metrics.observeRejected()
+		return nil, ErrUnavailable
+	}
+
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += t.retries
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(req, backoff(attempt)); err != nil {
+				return nil, err
+			}
+			slog.Warn("Retrying remnawave request", "method", req.Method, "path", req.URL.Path, "attempt", attempt)
+		}
+
+		start := time.Now()
+		resp, err = t.base.RoundTrip(req)
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		t.metrics.observe(time.Since(start), failed)
+
+		if !failed {
+			if t.breaker.success() {
+				slog.Info("Remnawave circuit breaker closed", "panel", t.metrics.panel)
+				alert.Sendf(alert.PanelUnavailable, "Panel %s is reachable again", t.metrics.panel)
+			}
+			return resp, nil
+		}
+		if attempt < attempts-1 && resp != nil {
+			resp.Body.Close()
+		}
+	}
+
+	if t.breaker.failure() {
+		slog.Error("Remnawave circuit breaker opened", "panel", t.metrics.panel, "cooldown", breakerCooldown)
+		alert.Sendf(alert.PanelUnavailable, "Panel %s is unreachable after %d failed requests: %s", t.metrics.panel, breakerThreshold, describe(resp, err))
+	}
+	return resp, err
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	return delay/2 + rand.N(delay)
+}
+
+func sleep(req *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow lets requests through while the breaker is closed and a single probe once the cooldown is over.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful request and reports whether it closed the open breaker.
+func (b *breaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= breakerThreshold
+	b.failures = 0
+	b.probing = false
+	return wasOpen
+}
+
+// failure records a failed request and reports whether it opened the breaker.
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.failures < breakerThreshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(breakerCooldown)
+	return b.failures == breakerThreshold
+}
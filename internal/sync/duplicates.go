@@ -0,0 +1,209 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
+	"github.com/google/uuid"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/remnawave"
+	"slices"
+	"sort"
+)
+
+// ErrDuplicateChanged means the panel users of the telegram id changed after the admin saw them.
+var ErrDuplicateChanged = errors.New("panel users changed since the confirmation")
+
+type PanelUser struct {
+	Panel string
+	User  remapi.UserDto
+}
+
+// Duplicate is a telegram id with several panel users. Keep is the index of the user
+// the customer is bound to, the others are the candidates for cleanup. Profile is the
+// telegram profile of the customer, empty if the bot doesn't know it.
+type Duplicate struct {
+	TelegramID int64
+	Profile    string
+	Users      []PanelUser
+	Keep       int
+}
+
+// FindDuplicates scans all panels for telegram ids that map to several panel users.
+func (s *SyncService) FindDuplicates(ctx context.Context) ([]Duplicate, error) {
+	usersByTelegramID := make(map[int64][]PanelUser)
+	for _, panelID := range s.panels.Names() {
+		err := s.panels.Get(&panelID).ForEachUsersPage(ctx, func(users []remapi.UserDto) error {
+			for _, user := range users {
+				if user.TelegramId.Null {
+					continue
+				}
+				telegramID := int64(user.TelegramId.Value)
+				usersByTelegramID[telegramID] = append(usersByTelegramID[telegramID], PanelUser{Panel: panelID, User: user})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get users from panel %s: %w", panelID, err)
+		}
+	}
+
+	var telegramIDs []int64
+	for telegramID, users := range usersByTelegramID {
+		if len(users) > 1 {
+			telegramIDs = append(telegramIDs, telegramID)
+		}
+	}
+	if len(telegramIDs) == 0 {
+		return nil, nil
+	}
+	sort.Slice(telegramIDs, func(i, j int) bool { return telegramIDs[i] < telegramIDs[j] })
+
+	customers, err := s.customerRepository.FindByTelegramIds(ctx, telegramIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find customers by telegram ids: %w", err)
+	}
+	customersMap := make(map[int64]*database.Customer, len(customers))
+	for i := range customers {
+		customersMap[customers[i].TelegramID] = &customers[i]
+	}
+
+	duplicates := make([]Duplicate, 0, len(telegramIDs))
+	for _, telegramID := range telegramIDs {
+		users := usersByTelegramID[telegramID]
+		var profile string
+		if customer, ok := customersMap[telegramID]; ok {
+			profile = customer.Profile()
+		}
+		duplicates = append(duplicates, Duplicate{
+			TelegramID: telegramID,
+			Profile:    profile,
+			Users:      users,
+			Keep:       keptUser(users, customersMap[telegramID], telegramID),
+		})
+	}
+	return duplicates, nil
+}
+
+// DuplicateUsers returns the panel users of the telegram id on all panels.
+func (s *SyncService) DuplicateUsers(ctx context.Context, telegramID int64) ([]PanelUser, error) {
+	var users []PanelUser
+	for _, panelID := range s.panels.Names() {
+		panelUsers, err := s.panels.Get(&panelID).GetUsersByTelegramId(ctx, telegramID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get users from panel %s: %w", panelID, err)
+		}
+		for _, user := range panelUsers {
+			users = append(users, PanelUser{Panel: panelID, User: user})
+		}
+	}
+	return users, nil
+}
+
+// UsersHash identifies the set of panel users, so a confirmation is only applied to the users the admin saw.
+func UsersHash(users []PanelUser) string {
+	uuids := make([]string, 0, len(users))
+	for _, user := range users {
+		uuids = append(uuids, user.User.UUID.String())
+	}
+	slices.Sort(uuids)
+	sum := sha256.Sum256([]byte(fmt.Sprint(uuids)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ResolveDuplicate deletes all panel users of the telegram id except the one with keepUUID, which the admin
+// confirmed. usersHash is the UsersHash of the users listed in the confirmation, if the users changed since then
+// nothing is deleted. With merge the kept user gets the latest expiration date of the deleted ones first, so no
+// paid time is lost.
+func (s *SyncService) ResolveDuplicate(ctx context.Context, telegramID int64, keepUUID uuid.UUID, usersHash string, merge bool) (*PanelUser, int, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, 0, ErrSyncInProgress
+	}
+	defer s.running.Store(false)
+
+	users, err := s.DuplicateUsers(ctx, telegramID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if UsersHash(users) != usersHash {
+		return nil, 0, ErrDuplicateChanged
+	}
+	keep := slices.IndexFunc(users, func(user PanelUser) bool { return user.User.UUID == keepUUID })
+	if keep < 0 {
+		return nil, 0, fmt.Errorf("panel user %s of telegram id %d not found", keepUUID, telegramID)
+	}
+
+	customer, err := s.customerRepository.FindByTelegramId(ctx, telegramID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kept := users[keep]
+	expireAt := kept.User.ExpireAt
+	for _, user := range users {
+		if user.User.UUID != kept.User.UUID && user.User.ExpireAt.After(expireAt) {
+			expireAt = user.User.ExpireAt
+		}
+	}
+
+	if merge && expireAt.After(kept.User.ExpireAt) {
+		updated, err := s.panels.Get(&kept.Panel).SetExpireAt(ctx, kept.User.UUID, expireAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to extend kept user: %w", err)
+		}
+		kept.User = *updated
+	}
+
+	deleted := 0
+	for _, user := range users {
+		if user.User.UUID == kept.User.UUID {
+			continue
+		}
+		if err := s.panels.Get(&user.Panel).DeleteUser(ctx, user.User.UUID); err != nil {
+			return nil, deleted, fmt.Errorf("failed to delete user %s: %w", user.User.UUID, err)
+		}
+		deleted++
+	}
+
+	if customer != nil {
+		err = s.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{
+			"remnawave_uuid":    kept.User.UUID,
+			"panel_id":          kept.Panel,
+			"expire_at":         kept.User.ExpireAt,
+			"subscription_link": kept.User.SubscriptionUrl,
+		})
+		if err != nil {
+			return nil, deleted, err
+		}
+	}
+
+	slog.Info("Duplicate panel users resolved", "telegramId", telegramID, "kept", kept.User.UUID, "deleted", deleted, "merge", merge)
+	return &kept, deleted, nil
+}
+
+// keptUser returns the index of the user bound to the customer, or the one PickUser would choose.
+func keptUser(users []PanelUser, customer *database.Customer, telegramID int64) int {
+	if customer != nil && customer.RemnawaveUUID != nil {
+		for i, user := range users {
+			if user.User.UUID == *customer.RemnawaveUUID {
+				return i
+			}
+		}
+	}
+
+	dtos := make([]remapi.UserDto, 0, len(users))
+	for _, user := range users {
+		dtos = append(dtos, user.User)
+	}
+	picked := remnawave.PickUser(dtos, telegramID)
+	for i, user := range users {
+		if user.User.UUID == picked.UUID {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+)
+
+type RestoreReport struct {
+	DryRun   bool
+	Checked  int
+	Restored []int64
+	Failed   []int64
+}
+
+// Restore is the reverse sync: it recreates the panel users of customers with an active subscription
+// that are missing in their panel, keeping the expiration date from the database.
+func (s *SyncService) Restore(ctx context.Context, dryRun bool) (*RestoreReport, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, ErrSyncInProgress
+	}
+	defer s.running.Store(false)
+
+	customers, err := s.customerRepository.FindWithActiveSubscription(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find customers with active subscription: %w", err)
+	}
+
+	report := &RestoreReport{DryRun: dryRun, Checked: len(customers)}
+	for _, customer := range customers {
+		client := s.panels.Get(customer.PanelID)
+		user, err := client.GetUser(ctx, customer.RemnawaveUUID, customer.TelegramID)
+		if err != nil {
+			slog.Error("Error getting panel user", "telegramId", customer.TelegramID, "error", err)
+			report.Failed = append(report.Failed, customer.TelegramID)
+			continue
+		}
+		if user != nil {
+			continue
+		}
+		if dryRun {
+			report.Restored = append(report.Restored, customer.TelegramID)
+			continue
+		}
+
+		if err := s.restoreCustomer(ctx, customer); err != nil {
+			slog.Error("Error restoring panel user", "telegramId", customer.TelegramID, "error", err)
+			report.Failed = append(report.Failed, customer.TelegramID)
+			continue
+		}
+		report.Restored = append(report.Restored, customer.TelegramID)
+	}
+
+	slog.Info("Restore completed", "checked", report.Checked, "restored", len(report.Restored), "failed", len(report.Failed))
+	return report, nil
+}
+
+func (s *SyncService) restoreCustomer(ctx context.Context, customer database.Customer) error {
+	trafficLimit, trafficStrategy := config.TrafficLimit(), config.TrafficLimitStrategy()
+	if customer.TrialUsedAt != nil {
+		paid, err := s.purchaseRepository.HasPaid(ctx, customer.ID)
+		if err != nil {
+			return err
+		}
+		if !paid {
+			trafficLimit, trafficStrategy = config.TrialTrafficLimit(), config.TrialTrafficLimitStrategy()
+		}
+	}
+
+	user, err := s.panels.Get(customer.PanelID).RestoreUser(ctx, customer.ID, customer.TelegramID, customer.Profile(), trafficLimit, *customer.ExpireAt, trafficStrategy)
+	if err != nil {
+		return err
+	}
+
+	return s.customerRepository.UpdateFields(ctx, customer.ID, map[string]interface{}{
+		"subscription_link": user.SubscriptionUrl,
+		"archived_at":       nil,
+		"panel_id":          s.panels.Name(customer.PanelID),
+		"remnawave_uuid":    user.UUID,
+	})
+}
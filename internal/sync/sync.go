@@ -2,61 +2,162 @@ package sync
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	remapi "github.com/Jolymmiles/remnawave-api-go/api"
 	"log/slog"
 	"remnawave-tg-shop-bot/internal/database"
 	"remnawave-tg-shop-bot/internal/remnawave"
+	"sync/atomic"
 	"time"
 )
 
+// maxArchiveRatio protects against archiving most of the customers when a panel returns an incomplete user list.
+const maxArchiveRatio = 0.5
+
+var ErrSyncInProgress = errors.New("sync is already in progress")
+
 type SyncService struct {
-	client             *remnawave.Client
+	panels             *remnawave.Panels
 	customerRepository *database.CustomerRepository
+	syncRunRepository  *database.SyncRunRepository
+	purchaseRepository *database.PurchaseRepository
+	running            atomic.Bool
 }
 
-func NewSyncService(client *remnawave.Client, customerRepository *database.CustomerRepository) *SyncService {
+func NewSyncService(panels *remnawave.Panels, customerRepository *database.CustomerRepository, syncRunRepository *database.SyncRunRepository, purchaseRepository *database.PurchaseRepository) *SyncService {
 	return &SyncService{
-		client: client, customerRepository: customerRepository,
+		panels: panels, customerRepository: customerRepository, syncRunRepository: syncRunRepository, purchaseRepository: purchaseRepository,
 	}
 }
 
-func (s SyncService) Sync() {
-	ctx := context.Background()
+type Options struct {
+	Trigger string
+	DryRun  bool
+	// Archive marks customers missing in the panel as archived. It needs the full user list,
+	// so it is done only after all pages have been processed.
+	Archive bool
+}
+
+type Report struct {
+	DryRun          bool
+	PanelUsers      int
+	Created         []int64
+	Updated         []int64
+	Restored        []int64
+	Archived        []int64
+	ArchiveSkipped  bool
+	ActiveCustomers int
+}
+
+// Sync brings the customers in line with the users of all panels page by page, writing only the customers
+// whose subscription or panel changed. Customers without a stored panel user take the first one seen.
+// With DryRun the changes are only calculated and reported.
+func (s *SyncService) Sync(ctx context.Context, opts Options) (*Report, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, ErrSyncInProgress
+	}
+	defer s.running.Store(false)
+
+	startedAt := time.Now()
+	report, err := s.sync(ctx, opts)
+	if !opts.DryRun {
+		s.saveRun(ctx, opts.Trigger, startedAt, report, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Synchronization completed", "trigger", opts.Trigger, "created", len(report.Created),
+		"updated", len(report.Updated), "restored", len(report.Restored), "archived", len(report.Archived))
+	return report, nil
+}
+
+func (s *SyncService) LastRun(ctx context.Context) (*database.SyncRun, error) {
+	return s.syncRunRepository.FindLast(ctx)
+}
+
+func (s *SyncService) sync(ctx context.Context, opts Options) (*Report, error) {
+	report := &Report{DryRun: opts.DryRun}
+
 	var telegramIDs []int64
-	telegramIDsSet := make(map[int64]int64)
-	var mappedUsers []database.Customer
-	users, err := s.client.GetUsers(ctx)
+	telegramIDsSet := make(map[int64]struct{})
+	for _, panelID := range s.panels.Names() {
+		if err := s.syncPanel(ctx, panelID, telegramIDsSet, &telegramIDs, report); err != nil {
+			return report, fmt.Errorf("failed to sync users from panel %s: %w", panelID, err)
+		}
+	}
+	if report.PanelUsers == 0 {
+		return report, errors.New("no users found in remnawave")
+	}
+
+	if !opts.Archive {
+		return report, nil
+	}
+
+	toArchive, err := s.customerRepository.FindNotArchivedExcept(ctx, telegramIDs)
 	if err != nil {
-		slog.Error("Error while getting users from remnawave")
-		return
+		return report, fmt.Errorf("failed to find customers missing in panel: %w", err)
 	}
-	if users == nil || len(*users) == 0 {
-		slog.Error("No users found in remnawave")
-		return
+	for _, cust := range toArchive {
+		report.Archived = append(report.Archived, cust.TelegramID)
 	}
 
-	for _, user := range *users {
-		if user.TelegramId.Null {
-			continue
-		}
-		if _, exists := telegramIDsSet[int64(user.TelegramId.Value)]; exists {
-			continue
-		}
+	report.ActiveCustomers = report.PanelUsers - len(report.Created) - len(report.Restored) + len(toArchive)
+	if report.ActiveCustomers > 0 && float64(len(toArchive))/float64(report.ActiveCustomers) > maxArchiveRatio {
+		report.ArchiveSkipped = true
+	}
 
-		telegramIDsSet[int64(user.TelegramId.Value)] = int64(user.TelegramId.Value)
+	if opts.DryRun {
+		return report, nil
+	}
 
-		telegramIDs = append(telegramIDs, int64(user.TelegramId.Value))
+	if report.ArchiveSkipped {
+		slog.Warn("Too many customers missing in panel, archiving skipped", "missing", len(toArchive), "active", report.ActiveCustomers)
+		return report, nil
+	}
+	if err := s.customerRepository.ArchiveByTelegramIds(ctx, report.Archived); err != nil {
+		return report, fmt.Errorf("failed to archive customers: %w", err)
+	}
+	slog.Info("Archived clients which not exist in panel", "count", len(report.Archived))
+
+	return report, nil
+}
+
+func (s *SyncService) syncPanel(ctx context.Context, panelID string, telegramIDsSet map[int64]struct{}, telegramIDs *[]int64, report *Report) error {
+	return s.panels.Get(&panelID).ForEachUsersPage(ctx, func(users []remapi.UserDto) error {
+		var panelUsers []database.Customer
+		for _, user := range users {
+			if user.TelegramId.Null {
+				continue
+			}
+			panelUsers = append(panelUsers, database.Customer{
+				TelegramID:       int64(user.TelegramId.Value),
+				ExpireAt:         &user.ExpireAt,
+				SubscriptionLink: &user.SubscriptionUrl,
+				CreatedAt:        user.CreatedAt,
+				PanelID:          &panelID,
+				RemnawaveUUID:    &user.UUID,
+			})
+		}
+		return s.syncPage(ctx, panelUsers, telegramIDsSet, telegramIDs, report)
+	})
+}
+
+// syncPage applies one page of panel users. A customer with a stored panel user is only updated from that user,
+// so duplicates of the telegram id are ignored; the others take the first user seen.
+func (s *SyncService) syncPage(ctx context.Context, panelUsers []database.Customer, telegramIDsSet map[int64]struct{}, telegramIDs *[]int64, report *Report) error {
+	if len(panelUsers) == 0 {
+		return nil
+	}
 
-		mappedUsers = append(mappedUsers, database.Customer{
-			TelegramID:       int64(user.TelegramId.Value),
-			ExpireAt:         &user.ExpireAt,
-			SubscriptionLink: &user.SubscriptionUrl,
-		})
+	pageTelegramIDs := make([]int64, 0, len(panelUsers))
+	for _, cust := range panelUsers {
+		pageTelegramIDs = append(pageTelegramIDs, cust.TelegramID)
 	}
 
-	existingCustomers, err := s.customerRepository.FindByTelegramIds(ctx, telegramIDs)
+	existingCustomers, err := s.customerRepository.FindByTelegramIds(ctx, pageTelegramIDs)
 	if err != nil {
-		slog.Error("Error while searching users by telegram ids")
-		return
+		return fmt.Errorf("failed to find customers by telegram ids: %w", err)
 	}
 	existingMap := make(map[int64]database.Customer)
 	for _, cust := range existingCustomers {
@@ -65,36 +166,76 @@ func (s SyncService) Sync() {
 
 	var toCreate []database.Customer
 	var toUpdate []database.Customer
+	for _, cust := range panelUsers {
+		if _, exists := telegramIDsSet[cust.TelegramID]; exists {
+			continue
+		}
+		existing, found := existingMap[cust.TelegramID]
+		if found && existing.RemnawaveUUID != nil && *existing.RemnawaveUUID != *cust.RemnawaveUUID {
+			continue
+		}
 
-	for _, cust := range mappedUsers {
-		if _, found := existingMap[cust.TelegramID]; found {
-			cust.CreatedAt = time.Now()
-			toUpdate = append(toUpdate, cust)
-		} else {
+		telegramIDsSet[cust.TelegramID] = struct{}{}
+		*telegramIDs = append(*telegramIDs, cust.TelegramID)
+		report.PanelUsers++
+
+		switch {
+		case !found:
 			toCreate = append(toCreate, cust)
+			report.Created = append(report.Created, cust.TelegramID)
+		case existing.ArchivedAt != nil:
+			toUpdate = append(toUpdate, cust)
+			report.Restored = append(report.Restored, cust.TelegramID)
+		case s.isChanged(existing, cust):
+			toUpdate = append(toUpdate, cust)
+			report.Updated = append(report.Updated, cust.TelegramID)
 		}
 	}
 
-	err = s.customerRepository.DeleteByNotInTelegramIds(ctx, telegramIDs)
-	if err != nil {
-		slog.Error("Error while deleting users")
+	if report.DryRun {
+		return nil
 	}
-	slog.Info("Deleted clients which not exist in panel")
 
-	if len(toCreate) > 0 {
-		if err := s.customerRepository.CreateBatch(ctx, toCreate); err != nil {
-			slog.Error("Error while creating users")
-		} else {
-			slog.Info("Created clients", "count", len(toCreate))
-		}
+	if err := s.customerRepository.CreateBatch(ctx, toCreate); err != nil {
+		return fmt.Errorf("failed to create customers: %w", err)
 	}
+	if err := s.customerRepository.UpdateBatch(ctx, toUpdate); err != nil {
+		return fmt.Errorf("failed to update customers: %w", err)
+	}
+	return nil
+}
 
-	if len(toUpdate) > 0 {
-		if err := s.customerRepository.UpdateBatch(ctx, toUpdate); err != nil {
-			slog.Error("Error while updating users")
-		} else {
-			slog.Info("Updated clients", "count", len(toUpdate))
+func (s *SyncService) saveRun(ctx context.Context, trigger string, startedAt time.Time, report *Report, syncErr error) {
+	run := &database.SyncRun{
+		Trigger:    trigger,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+	if report != nil {
+		run.PanelUsers = report.PanelUsers
+		run.Created = len(report.Created)
+		run.Updated = len(report.Updated)
+		run.Restored = len(report.Restored)
+		if !report.ArchiveSkipped {
+			run.Archived = len(report.Archived)
 		}
 	}
-	slog.Info("Synchronization completed")
+	if syncErr != nil {
+		errText := syncErr.Error()
+		run.Error = &errText
+	}
+
+	if err := s.syncRunRepository.Create(ctx, run); err != nil {
+		slog.Error("Error saving sync run", "error", err)
+	}
+}
+
+func (s *SyncService) isChanged(existing database.Customer, panel database.Customer) bool {
+	if existing.ExpireAt == nil || !existing.ExpireAt.Equal(*panel.ExpireAt) {
+		return true
+	}
+	if s.panels.Name(existing.PanelID) != *panel.PanelID || existing.RemnawaveUUID == nil {
+		return true
+	}
+	return existing.SubscriptionLink == nil || *existing.SubscriptionLink != *panel.SubscriptionLink
 }
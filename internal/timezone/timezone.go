@@ -0,0 +1,100 @@
+package timezone
+
+import (
+	"fmt"
+	"log/slog"
+	"remnawave-tg-shop-bot/internal/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// languageTimezones maps the telegram language code to the most likely timezone of its speakers.
+var languageTimezones = map[string]string{
+	"ru": "Europe/Moscow",
+	"uk": "Europe/Kyiv",
+	"be": "Europe/Minsk",
+	"kk": "Asia/Almaty",
+	"uz": "Asia/Tashkent",
+	"ky": "Asia/Bishkek",
+	"tg": "Asia/Dushanbe",
+	"hy": "Asia/Yerevan",
+	"ka": "Asia/Tbilisi",
+	"az": "Asia/Baku",
+	"tr": "Europe/Istanbul",
+	"fa": "Asia/Tehran",
+	"de": "Europe/Berlin",
+	"fr": "Europe/Paris",
+	"es": "Europe/Madrid",
+	"it": "Europe/Rome",
+	"pl": "Europe/Warsaw",
+	"zh": "Asia/Shanghai",
+	"ja": "Asia/Tokyo",
+	"ko": "Asia/Seoul",
+	"id": "Asia/Jakarta",
+	"vi": "Asia/Ho_Chi_Minh",
+}
+
+// options are the timezones offered in the settings, from west to east.
+var options = []string{
+	"America/New_York",
+	"UTC",
+	"Europe/Berlin",
+	"Europe/Kaliningrad",
+	"Europe/Kyiv",
+	"Europe/Moscow",
+	"Europe/Samara",
+	"Asia/Yekaterinburg",
+	"Asia/Omsk",
+	"Asia/Novosibirsk",
+	"Asia/Irkutsk",
+	"Asia/Yakutsk",
+	"Asia/Vladivostok",
+	"Asia/Magadan",
+}
+
+var locations sync.Map
+
+// Options returns the timezones the user can choose in the settings.
+func Options() []string {
+	return options
+}
+
+// FromLanguage infers the timezone from the telegram language code, e.g. "ru" or "pt-br",
+// falling back to DEFAULT_TIMEZONE.
+func FromLanguage(langCode string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(langCode), "-")
+	if name, ok := languageTimezones[lang]; ok {
+		return name
+	}
+	return config.DefaultTimezone()
+}
+
+// Load returns the location of the timezone, or UTC if the name is unknown.
+func Load(name string) *time.Location {
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("Unknown timezone, using UTC", "timezone", name, "error", err)
+		location = time.UTC
+	}
+	locations.Store(name, location)
+	return location
+}
+
+// Label renders the timezone for the user, e.g. "Moscow (UTC+03:00)".
+func Label(name string) string {
+	city := name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		city = name[i+1:]
+	}
+	_, offset := time.Now().In(Load(name)).Zone()
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s (UTC%s%02d:%02d)", strings.ReplaceAll(city, "_", " "), sign, offset/3600, offset%3600/60)
+}
@@ -69,6 +69,15 @@ func (tm *Manager) InitTranslations(translationsDir string) error {
 	return nil
 }
 
+// HasText reports whether the key is translated in the default language, i.e. GetText won't return the key itself.
+func (tm *Manager) HasText(key string) bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	_, exists := tm.translations[tm.defaultLanguage][key]
+	return exists
+}
+
 func (tm *Manager) GetText(langCode, key string) string {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
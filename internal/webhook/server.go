@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"io"
+	"log/slog"
+	"net/http"
+	"remnawave-tg-shop-bot/internal/config"
+	"remnawave-tg-shop-bot/internal/database"
+	"remnawave-tg-shop-bot/internal/translation"
+	"strings"
+	"time"
+)
+
+const (
+	signatureHeader = "X-Remnawave-Signature"
+	maxBodySize     = 1 << 20
+)
+
+type Event struct {
+	Event string    `json:"event"`
+	Data  EventUser `json:"data"`
+}
+
+type EventUser struct {
+	UUID              string    `json:"uuid"`
+	Username          string    `json:"username"`
+	Status            string    `json:"status"`
+	TelegramID        *int64    `json:"telegramId"`
+	ExpireAt          time.Time `json:"expireAt"`
+	SubscriptionUrl   string    `json:"subscriptionUrl"`
+	UsedTrafficBytes  float64   `json:"usedTrafficBytes"`
+	TrafficLimitBytes int64     `json:"trafficLimitBytes"`
+}
+
+// notifications maps the lifecycle events to the translation key of the user message
+// and the callback of the button attached to it.
+var notifications = map[string]struct {
+	textKey   string
+	buttonKey string
+	callback  string
+}{
+	"user.expired":         {textKey: "webhook_user_expired", buttonKey: "renew_subscription_button", callback: "buy"},
+	"user.limited":         {textKey: "webhook_user_limited", buttonKey: "renew_subscription_button", callback: "buy"},
+	"user.traffic_reached": {textKey: "webhook_user_limited", buttonKey: "renew_subscription_button", callback: "buy"},
+	"user.disabled":        {textKey: "webhook_user_disabled", buttonKey: "support_button", callback: ""},
+	"user.enabled":         {textKey: "webhook_user_enabled", buttonKey: "connect_button", callback: "connect"},
+}
+
+type Server struct {
+	customerRepository *database.CustomerRepository
+	telegramBot        *bot.Bot
+	translation        *translation.Manager
+	mux                *http.ServeMux
+}
+
+func NewServer(customerRepository *database.CustomerRepository, telegramBot *bot.Bot, translation *translation.Manager) *Server {
+	s := &Server{
+		customerRepository: customerRepository,
+		telegramBot:        telegramBot,
+		translation:        translation,
+		mux:                http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/webhook/remnawave", s.handleRemnawave)
+	return s
+}
+
+// Start serves webhooks until the context is cancelled.
+func (s *Server) Start(ctx context.Context) {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", config.WebhookPort()),
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down webhook server", "error", err)
+		}
+	}()
+
+	slog.Info("Webhook server is starting", "port", config.WebhookPort())
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Webhook server stopped", "error", err)
+	}
+}
+
+func (s *Server) handleRemnawave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !verifySignature(body, r.Header.Get(signatureHeader), config.WebhookSecret()) {
+		slog.Warn("Rejected webhook with invalid signature", "remoteAddr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		slog.Error("Error decoding webhook", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.processEvent(r.Context(), &event); err != nil {
+		slog.Error("Error processing webhook", "event", event.Event, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func verifySignature(body []byte, signature string, secret string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func (s *Server) processEvent(ctx context.Context, event *Event) error {
+	if event.Data.TelegramID == nil {
+		return nil
+	}
+	notification, ok := notifications[event.Event]
+	if !ok {
+		return nil
+	}
+
+	customer, err := s.customerRepository.FindByTelegramId(ctx, *event.Data.TelegramID)
+	if err != nil {
+		return err
+	}
+	if customer == nil {
+		slog.Warn("Webhook for unknown customer", "event", event.Event, "telegramId", *event.Data.TelegramID)
+		return nil
+	}
+	// a duplicate panel user of the telegram id, e.g. on another panel, must not override the bound subscription
+	if customer.RemnawaveUUID != nil && !strings.EqualFold(customer.RemnawaveUUID.String(), event.Data.UUID) {
+		slog.Info("Webhook for a panel user not bound to the customer", "event", event.Event, "customerId", customer.ID, "uuid", event.Data.UUID)
+		return nil
+	}
+
+	updates := map[string]interface{}{}
+	if !event.Data.ExpireAt.IsZero() {
+		updates["expire_at"] = event.Data.ExpireAt
+	}
+	if event.Data.SubscriptionUrl != "" {
+		updates["subscription_link"] = event.Data.SubscriptionUrl
+	}
+	if err := s.customerRepository.UpdateFields(ctx, customer.ID, updates); err != nil {
+		return err
+	}
+
+	var keyboard [][]models.InlineKeyboardButton
+	if notification.callback != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: s.translation.GetText(customer.Language, notification.buttonKey), CallbackData: notification.callback},
+		})
+	} else if config.SupportURL() != "" {
+		keyboard = append(keyboard, []models.InlineKeyboardButton{
+			{Text: s.translation.GetText(customer.Language, notification.buttonKey), URL: config.SupportURL()},
+		})
+	}
+
+	_, err = s.telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      customer.TelegramID,
+		Text:        s.translation.GetText(customer.Language, notification.textKey),
+		ParseMode:   models.ParseModeHTML,
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+
+	slog.Info("Webhook processed", "event", event.Event, "customer_id", customer.ID)
+	return nil
+}
@@ -38,7 +38,7 @@ func NewClient(baseURL, shopID, secretKey string) *Client {
 	}
 }
 
-func (c *Client) CreateInvoice(ctx context.Context, amount int, month int, customerId int64, purchaseId int64) (*Payment, error) {
+func (c *Client) CreateInvoice(ctx context.Context, amount int, month int, customerId int64, purchaseId int64, profile string) (*Payment, error) {
 	rub := Amount{
 		Value:    strconv.Itoa(amount),
 		Currency: "RUB",
@@ -74,7 +74,7 @@ func (c *Client) CreateInvoice(ctx context.Context, amount int, month int, custo
 	metaData := map[string]any{
 		"customerId": customerId,
 		"purchaseId": purchaseId,
-		"username":   ctx.Value("username"),
+		"profile":    profile,
 	}
 
 	paymentRequest := NewPaymentRequest(